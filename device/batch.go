@@ -0,0 +1,156 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+type Request struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+type BatchResult struct {
+	Method    string          `json:"method"`
+	ErrorCode int             `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// BatchResults holds the result of every method in a batch.
+type BatchResults map[string]*BatchResult
+
+type multipleRequestParams struct {
+	Requests []Request `json:"requests"`
+}
+
+type multipleRequestResponse struct {
+	protocol.AesProtoBaseResponse
+	Result struct {
+		Responses []*BatchResult `json:"responses"`
+	} `json:"result"`
+}
+
+type singleResponse struct {
+	protocol.AesProtoBaseResponse
+	Result json.RawMessage `json:"result"`
+}
+
+// Err returns the error the device reported for the method, if any.
+func (r *BatchResult) Err() error {
+	if r.ErrorCode != 0 {
+		return &protocol.DeviceError{Method: r.Method, Code: protocol.ErrorCode(r.ErrorCode)}
+	}
+
+	return nil
+}
+
+// Decode unmarshals the result of the method into v, or returns the
+// error the device reported for it.
+func (r BatchResults) Decode(method string, v interface{}) error {
+	result, ok := r[method]
+
+	if !ok {
+		return fmt.Errorf("no response for %s in batch", method)
+	}
+
+	if err := result.Err(); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(result.Result, v)
+}
+
+func (r BatchResults) EnergyUsage() (*EnergyUsageResult, error) {
+	var result EnergyUsageResult
+
+	if err := r.Decode("get_energy_usage", &result); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+func (r BatchResults) DeviceInfo() (*DeviceInfoResult, error) {
+	var result DeviceInfoResult
+
+	if err := r.Decode("get_device_info", &result); err != nil {
+		return nil, err
+	}
+
+	result.decode()
+
+	return &result, nil
+}
+
+// Batch sends the requests in a single multipleRequest round trip. The
+// returned error is for the batch as a whole, errors of the individual
+// methods are returned when decoding their results. Devices that don't
+// know multipleRequest get the requests one by one instead.
+func (d *Device) Batch(ctx context.Context, requests ...Request) (BatchResults, error) {
+	if d.batchUnsupported.Load() {
+		return d.sequential(ctx, requests)
+	}
+
+	var response multipleRequestResponse
+
+	err := d.transport.SendContext(ctx, &Request{
+		Method: "multipleRequest",
+		Params: &multipleRequestParams{Requests: requests},
+	}, &response)
+
+	if err == nil && response.ErrorCode != 0 {
+		err = &protocol.DeviceError{Method: "multipleRequest", Code: protocol.ErrorCode(response.ErrorCode)}
+	}
+
+	if errors.Is(err, protocol.ErrUnsupportedMethod) {
+		d.batchUnsupported.Store(true)
+		return d.sequential(ctx, requests)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(BatchResults, len(response.Result.Responses))
+
+	for _, result := range response.Result.Responses {
+		results[result.Method] = result
+	}
+
+	return results, nil
+}
+
+func (d *Device) sequential(ctx context.Context, requests []Request) (BatchResults, error) {
+	results := make(BatchResults, len(requests))
+
+	for _, request := range requests {
+		var response singleResponse
+
+		if err := d.transport.SendContext(ctx, &request, &response); err != nil {
+			var deviceErr *protocol.DeviceError
+
+			// report errors for the method itself with its result
+			if errors.As(err, &deviceErr) && deviceErr.Method == request.Method {
+				results[request.Method] = &BatchResult{
+					Method:    request.Method,
+					ErrorCode: int(deviceErr.Code),
+				}
+				continue
+			}
+
+			return nil, err
+		}
+
+		results[request.Method] = &BatchResult{
+			Method:    request.Method,
+			ErrorCode: response.ErrorCode,
+			Result:    response.Result,
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,80 @@
+package device
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// StateError is a device that doesn't report the state it was set to
+// when read back.
+type StateError struct {
+	Expected bool
+	Actual   bool
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("device reports device_on %t after setting it to %t", e.Actual, e.Expected)
+}
+
+func (e *StateError) Is(target error) bool {
+	return target == protocol.ErrDeviceFailure
+}
+
+type deviceInfoParams struct {
+	DeviceOn bool `json:"device_on"`
+}
+
+// SetDeviceOn switches the device on or off, and reads the state back to
+// confirm it. Control requests go ahead of queued monitoring requests.
+func (d *Device) SetDeviceOn(ctx context.Context, on bool) error {
+	ctx = protocol.WithPriority(ctx, protocol.PriorityControl)
+
+	var response singleResponse
+
+	err := d.transport.SendContext(ctx, &Request{
+		Method: "set_device_info",
+		Params: &deviceInfoParams{DeviceOn: on},
+	}, &response)
+
+	if err != nil {
+		return err
+	}
+
+	if response.ErrorCode != 0 {
+		return &protocol.DeviceError{Method: "set_device_info", Code: protocol.ErrorCode(response.ErrorCode)}
+	}
+
+	info, err := d.GetDeviceInfo(ctx)
+
+	if err != nil {
+		return fmt.Errorf("confirming device_on: %w", err)
+	}
+
+	if info.DeviceOn != on {
+		return &StateError{Expected: on, Actual: info.DeviceOn}
+	}
+
+	return nil
+}
+
+// Toggle switches the device off if it is on and on otherwise, and
+// returns the new state.
+func (d *Device) Toggle(ctx context.Context) (bool, error) {
+	ctx = protocol.WithPriority(ctx, protocol.PriorityControl)
+
+	info, err := d.GetDeviceInfo(ctx)
+
+	if err != nil {
+		return false, err
+	}
+
+	on := !info.DeviceOn
+
+	if err := d.SetDeviceOn(ctx, on); err != nil {
+		return false, err
+	}
+
+	return on, nil
+}
@@ -0,0 +1,156 @@
+package device_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/device"
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+var credentials = model.Credentials{Username: "user@example.com", Password: "password"}
+
+func newDevice(t *testing.T) (*device.Device, *devicetest.Device) {
+	fake := devicetest.NewDevice(credentials)
+	t.Cleanup(fake.Close)
+
+	key, err := protocol.GenerateKey(1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := device.NewDevice(key, fake.Config())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, fake
+}
+
+func expectDeviceOn(t *testing.T, d *device.Device, on bool) {
+	t.Helper()
+
+	info, err := d.GetDeviceInfo(context.Background())
+
+	if err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	if info.DeviceOn != on {
+		t.Errorf("got device_on %t, expected %t", info.DeviceOn, on)
+	}
+}
+
+func TestSetDeviceOn(t *testing.T) {
+	d, fake := newDevice(t)
+
+	for _, on := range []bool{false, true} {
+		if err := d.SetDeviceOn(context.Background(), on); err != nil {
+			t.Fatalf("switching device_on to %t failed: %v", on, err)
+		}
+
+		expectDeviceOn(t, d, on)
+	}
+
+	if calls := fake.Calls("set_device_info"); calls != 2 {
+		t.Errorf("got %d set_device_info, expected 2", calls)
+	}
+}
+
+func TestToggle(t *testing.T) {
+	d, _ := newDevice(t)
+
+	for _, expected := range []bool{false, true} {
+		on, err := d.Toggle(context.Background())
+
+		if err != nil {
+			t.Fatalf("toggle failed: %v", err)
+		}
+
+		if on != expected {
+			t.Errorf("got device_on %t after toggling, expected %t", on, expected)
+		}
+
+		expectDeviceOn(t, d, expected)
+	}
+}
+
+func TestSetDeviceOnErrorCode(t *testing.T) {
+	d, fake := newDevice(t)
+
+	fake.InjectFault(devicetest.Fault{Method: "set_device_info", ErrorCode: protocol.ErrorCodeInvalidParams})
+
+	err := d.SetDeviceOn(context.Background(), false)
+
+	var deviceErr *protocol.DeviceError
+
+	if !errors.As(err, &deviceErr) {
+		t.Fatalf("got %v, expected a device error", err)
+	}
+
+	if deviceErr.Method != "set_device_info" || deviceErr.Code != protocol.ErrorCodeInvalidParams {
+		t.Errorf("got %s failing with %d, expected set_device_info failing with %d", deviceErr.Method, deviceErr.Code, protocol.ErrorCodeInvalidParams)
+	}
+
+	// the state is only read back once it was set
+	if calls := fake.Calls("get_device_info"); calls != 0 {
+		t.Errorf("got %d get_device_info, expected none", calls)
+	}
+}
+
+// TestSetDeviceOnStateError expects a device accepting the command but
+// not switching to fail.
+func TestSetDeviceOnStateError(t *testing.T) {
+	d, fake := newDevice(t)
+
+	fake.Handle("set_device_info", devicetest.Result(map[string]interface{}{}))
+
+	err := d.SetDeviceOn(context.Background(), false)
+
+	var stateErr *device.StateError
+
+	if !errors.As(err, &stateErr) {
+		t.Fatalf("got %v, expected a state error", err)
+	}
+
+	if stateErr.Expected || !stateErr.Actual {
+		t.Errorf("got %+v, expected device_on to stay true", stateErr)
+	}
+
+	if !errors.Is(err, protocol.ErrDeviceFailure) {
+		t.Errorf("got %v, expected a device failure", err)
+	}
+}
+
+// TestSetDeviceOnLegacy expects legacy devices to switch their relay.
+func TestSetDeviceOnLegacy(t *testing.T) {
+	fake := devicetest.NewLegacyDevice()
+	t.Cleanup(fake.Close)
+
+	d, err := device.NewLegacyDevice(fake.Config())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.SetDeviceOn(context.Background(), false); err != nil {
+		t.Fatalf("switching the relay off failed: %v", err)
+	}
+
+	expectDeviceOn(t, d, false)
+
+	if on, err := d.Toggle(context.Background()); err != nil || !on {
+		t.Errorf("got device_on %t and %v after toggling, expected the relay on", on, err)
+	}
+
+	expectDeviceOn(t, d, true)
+
+	if calls := fake.Calls("set_device_info"); calls != 2 {
+		t.Errorf("got %d set_relay_state, expected 2", calls)
+	}
+}
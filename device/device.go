@@ -1,9 +1,10 @@
 package device
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/base64"
-	"fmt"
+	"sync/atomic"
 
 	"github.com/dehydr8/kasa-go/model"
 	"github.com/dehydr8/kasa-go/protocol"
@@ -12,6 +13,9 @@ import (
 type Device struct {
 	config    *model.DeviceConfig
 	transport protocol.Protocol
+
+	// set once the device rejected a multipleRequest
+	batchUnsupported atomic.Bool
 }
 
 type DeviceInfoResult struct {
@@ -56,64 +60,112 @@ func NewDevice(key *rsa.PrivateKey, config *model.DeviceConfig) (*Device, error)
 		return nil, err
 	}
 
+	return NewDeviceWithTransport(config, transport), nil
+}
+
+func NewKlapDevice(config *model.DeviceConfig) (*Device, error) {
+	transport, err := protocol.NewKlapTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDeviceWithTransport(config, transport), nil
+}
+
+func NewLegacyDevice(config *model.DeviceConfig) (*Device, error) {
+	transport, err := protocol.NewLegacyTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDeviceWithTransport(config, transport), nil
+}
+
+// NewCloudDevice reaches the device with the id in the address of the
+// config through the TP-Link cloud.
+func NewCloudDevice(config *model.DeviceConfig) (*Device, error) {
+	transport, err := protocol.NewCloudTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDeviceWithTransport(config, transport), nil
+}
+
+// NewChildDevice returns the child with the given device id of a power
+// strip or hub, such as an outlet or a sensor, reached through the
+// transport of the parent.
+func NewChildDevice(parent *Device, deviceId string) *Device {
+	return NewDeviceWithTransport(parent.config, protocol.NewChildTransport(parent.transport, deviceId))
+}
+
+func NewNegotiatedDevice(negotiator *protocol.Negotiator, config *model.DeviceConfig) *Device {
+	return NewDeviceWithTransport(config, negotiator.Transport(config))
+}
+
+func NewDeviceWithTransport(config *model.DeviceConfig, transport protocol.Protocol) *Device {
 	return &Device{
 		config:    config,
 		transport: transport,
-	}, nil
+	}
 }
 
 func (d *Device) Address() string {
 	return d.config.Address
 }
 
-func (d *Device) GetEnergyUsage() (*EnergyUsageResult, error) {
+func (d *Device) GetEnergyUsage(ctx context.Context) (*EnergyUsageResult, error) {
 	var response EnergyUsageResponse
 	req := map[string]interface{}{
 		"method": "get_energy_usage",
 	}
 
-	err := d.transport.Send(&req, &response)
+	err := d.transport.SendContext(ctx, &req, &response)
 
 	if err != nil {
 		return nil, err
 	}
 
 	if response.ErrorCode != 0 {
-		return nil, fmt.Errorf("error code: %d", response.ErrorCode)
+		return nil, &protocol.DeviceError{Method: "get_energy_usage", Code: protocol.ErrorCode(response.ErrorCode)}
 	}
 
 	return &response.Result, nil
 }
 
-func (d *Device) GetDeviceInfo() (*DeviceInfoResult, error) {
+func (d *Device) GetDeviceInfo(ctx context.Context) (*DeviceInfoResult, error) {
 	var response DeviceInfoResponse
 	req := map[string]interface{}{
 		"method": "get_device_info",
 	}
 
-	err := d.transport.Send(&req, &response)
+	err := d.transport.SendContext(ctx, &req, &response)
 
 	if err != nil {
 		return nil, err
 	}
 
 	if response.ErrorCode != 0 {
-		return nil, fmt.Errorf("error code: %d", response.ErrorCode)
+		return nil, &protocol.DeviceError{Method: "get_device_info", Code: protocol.ErrorCode(response.ErrorCode)}
 	}
 
+	response.Result.decode()
+
+	return &response.Result, nil
+}
+
+func (r *DeviceInfoResult) decode() {
 	// try decoding nickname
-	nickname, err := base64.StdEncoding.DecodeString(response.Result.Alias)
+	nickname, err := base64.StdEncoding.DecodeString(r.Alias)
 
 	if err == nil {
-		response.Result.Alias = string(nickname)
+		r.Alias = string(nickname)
 	}
 
 	// try decoding ssid
-	ssid, err := base64.StdEncoding.DecodeString(response.Result.SSID)
+	ssid, err := base64.StdEncoding.DecodeString(r.SSID)
 
 	if err == nil {
-		response.Result.SSID = string(ssid)
+		r.SSID = string(ssid)
 	}
-
-	return &response.Result, nil
 }
@@ -0,0 +1,225 @@
+package devicetest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// Cloud is a fake of the TP-Link cloud, relaying passthrough requests to
+// the handlers of its devices without going through their transport.
+type Cloud struct {
+	Server *httptest.Server
+
+	// Credentials are the credentials of the cloud account
+	Credentials model.Credentials
+
+	lock    sync.Mutex
+	devices map[string]*Device
+	tokens  map[string]bool
+	faults  faults
+	calls   map[string]int
+}
+
+// NewCloud starts a fake cloud accepting the given credentials.
+func NewCloud(credentials model.Credentials) *Cloud {
+	c := &Cloud{
+		Credentials: credentials,
+		devices:     make(map[string]*Device),
+		tokens:      make(map[string]bool),
+		calls:       make(map[string]int),
+	}
+
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serveHTTP))
+
+	return c
+}
+
+// AddDevice binds the device to the account under the given id, its
+// handlers, faults and MultipleRequest then answer the passthrough.
+func (c *Cloud) AddDevice(id string, device *Device) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.devices[id] = device
+}
+
+// Config returns a device config for the device with the given id over
+// the cloud.
+func (c *Cloud) Config(id string) *model.DeviceConfig {
+	credentials := c.Credentials
+
+	return &model.DeviceConfig{
+		Address:     id,
+		Credentials: &credentials,
+		CloudURL:    c.Server.URL,
+	}
+}
+
+func (c *Cloud) Close() {
+	c.Server.Close()
+}
+
+// InjectFault adds a fault for the "login" or "passthrough" method of the
+// cloud, faults of the inner methods are injected into the device.
+func (c *Cloud) InjectFault(fault Fault) {
+	c.faults.add(fault)
+}
+
+// ClearFaults removes all faults.
+func (c *Cloud) ClearFaults() {
+	c.faults.clear()
+}
+
+// ExpireTokens drops all tokens, as the cloud does after a while.
+func (c *Cloud) ExpireTokens() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.tokens = make(map[string]bool)
+}
+
+// Calls returns how many times the cloud method was requested.
+func (c *Cloud) Calls(method string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.calls[method]
+}
+
+func (c *Cloud) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req request
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeJsonDecodeFailed})
+		return
+	}
+
+	c.lock.Lock()
+	c.calls[req.Method]++
+	c.lock.Unlock()
+
+	if fault := c.faults.match(req.Method); fault != nil {
+		if fault.StatusCode != 0 {
+			w.WriteHeader(fault.StatusCode)
+		} else {
+			writeJSON(w, &response{ErrorCode: fault.ErrorCode})
+		}
+
+		return
+	}
+
+	switch req.Method {
+	case "login":
+		writeJSON(w, c.login(req.Params))
+	case "passthrough":
+		writeJSON(w, c.passthrough(r.URL.Query().Get("token"), req.Params))
+	default:
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeUnknownMethod})
+	}
+}
+
+func (c *Cloud) login(params json.RawMessage) *response {
+	var p struct {
+		AppType       string `json:"appType"`
+		CloudUserName string `json:"cloudUserName"`
+		CloudPassword string `json:"cloudPassword"`
+		TerminalUUID  string `json:"terminalUUID"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidParams}
+	}
+
+	if p.CloudUserName != c.Credentials.Username || p.CloudPassword != c.Credentials.Password {
+		return &response{ErrorCode: protocol.ErrorCodeCloudInvalidCredentials}
+	}
+
+	token := randomHex(16)
+
+	c.lock.Lock()
+	c.tokens[token] = true
+	c.lock.Unlock()
+
+	return &response{
+		Result: map[string]string{
+			"accountId": "1",
+			"email":     c.Credentials.Username,
+			"token":     token,
+		},
+	}
+}
+
+func (c *Cloud) passthrough(token string, params json.RawMessage) *response {
+	var p struct {
+		DeviceId    string `json:"deviceId"`
+		RequestData string `json:"requestData"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidParams}
+	}
+
+	c.lock.Lock()
+	valid := c.tokens[token]
+	device, ok := c.devices[p.DeviceId]
+	c.lock.Unlock()
+
+	if !valid {
+		return &response{ErrorCode: protocol.ErrorCodeCloudTokenExpired}
+	}
+
+	if !ok {
+		return &response{ErrorCode: protocol.ErrorCodeCloudDeviceOffline}
+	}
+
+	var req request
+
+	if err := json.Unmarshal([]byte(p.RequestData), &req); err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidParams}
+	}
+
+	device.count(req.Method)
+
+	var res *response
+
+	if fault := device.faults.match(req.Method); fault != nil {
+		// the cloud can't relay the status of the device
+		if fault.StatusCode != 0 {
+			return &response{ErrorCode: protocol.ErrorCodeCloudDeviceOffline}
+		}
+
+		res = &response{ErrorCode: fault.ErrorCode}
+	} else {
+		res = device.dispatch(req)
+	}
+
+	marshalled, err := json.Marshal(res)
+
+	if err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeJsonEncodeFailed}
+	}
+
+	return &response{
+		Result: map[string]string{
+			"responseData": string(marshalled),
+		},
+	}
+}
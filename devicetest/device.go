@@ -0,0 +1,751 @@
+// Package devicetest provides in-process fakes of a device speaking the
+// securePassthrough (AES) protocol, KLAP, the HTTPS API of newer firmware
+// or the XOR protocol of older devices, and of the TP-Link cloud, for
+// testing transports and exporters without the hardware.
+package devicetest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+const sessionCookie = "TP_SESSIONID"
+
+// Handler answers a method with its result, or an error code.
+type Handler func(params json.RawMessage) (interface{}, protocol.ErrorCode)
+
+// Fault makes the device fail requests instead of answering them.
+type Fault struct {
+	// Method is the method to fail: "handshake", "login_device",
+	// "securePassthrough", "handshake1", "handshake2", "request", a method
+	// name, or empty for every request
+	Method string
+
+	// StatusCode is the HTTP status to answer with, if set
+	StatusCode int
+
+	// ErrorCode is the error code to answer with, if set
+	ErrorCode protocol.ErrorCode
+
+	// Delay is added before answering, for timeouts
+	Delay time.Duration
+
+	// Times is how many requests fail, 0 for all of them
+	Times int
+}
+
+// Device is a fake device listening on a local address.
+type Device struct {
+	// Server serves the device, nil for legacy devices
+	Server *httptest.Server
+
+	// Credentials are the credentials the device accepts
+	Credentials model.Credentials
+
+	// LoginVersion restricts the accepted login version to 1 or 2, both
+	// are accepted if 0
+	LoginVersion int
+
+	// SessionTimeout expires sessions after the given time, if set
+	SessionTimeout time.Duration
+
+	// MultipleRequest can be disabled to emulate old firmware
+	MultipleRequest bool
+
+	// listener serves legacy devices
+	listener net.Listener
+
+	// certificate replaces the one of the server of TLS devices, once
+	// rotated
+	certificate *tls.Certificate
+
+	lock         sync.Mutex
+	handlers     map[string]Handler
+	faults       faults
+	sessions     map[string]*session
+	klapSessions map[string]*klapSession
+	calls        map[string]int
+	children     map[string]*Device
+	tokens       map[string]bool
+	info         map[string]interface{}
+}
+
+type session struct {
+	block   cipher.Block
+	iv      []byte
+	token   string
+	created time.Time
+}
+
+// NewDevice starts a fake device accepting the given credentials, which
+// answers get_device_info and get_energy_usage with DefaultDeviceInfo and
+// DefaultEnergyUsage. set_device_info updates the device info, such as
+// device_on.
+func NewDevice(credentials model.Credentials) *Device {
+	d := newDevice(credentials)
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serveHTTP))
+
+	return d
+}
+
+func newDevice(credentials model.Credentials) *Device {
+	d := &Device{
+		Credentials:     credentials,
+		MultipleRequest: true,
+		handlers:        make(map[string]Handler),
+		sessions:        make(map[string]*session),
+		klapSessions:    make(map[string]*klapSession),
+		calls:           make(map[string]int),
+		children:        make(map[string]*Device),
+		tokens:          make(map[string]bool),
+		info:            make(map[string]interface{}, len(DefaultDeviceInfo)),
+	}
+
+	for key, value := range DefaultDeviceInfo {
+		d.info[key] = value
+	}
+
+	d.Handle("get_device_info", d.getDeviceInfo)
+	d.Handle("set_device_info", d.setDeviceInfo)
+	d.Handle("get_energy_usage", Result(DefaultEnergyUsage))
+
+	return d
+}
+
+// DefaultDeviceInfo is the get_device_info result of a new device.
+var DefaultDeviceInfo = map[string]interface{}{
+	"device_id": "8022D3E0A2C5E0F1F4BDB8D6E2E2E2E2E2E2E2E2",
+	"device_on": true,
+	"model":     "P110",
+	"type":      "SMART.TAPOPLUG",
+	"nickname":  base64.StdEncoding.EncodeToString([]byte("Fake Plug")),
+	"rssi":      -50,
+	"on_time":   3600,
+	"sw_ver":    "1.0.0 Build 000000 Rel.000000",
+	"hw_ver":    "1.0",
+	"mac":       "AA-BB-CC-DD-EE-FF",
+	"ssid":      base64.StdEncoding.EncodeToString([]byte("Fake Network")),
+}
+
+// DefaultEnergyUsage is the get_energy_usage result of a new device.
+var DefaultEnergyUsage = map[string]interface{}{
+	"current_power": 12345,
+	"month_energy":  1000,
+	"month_runtime": 6000,
+	"today_energy":  100,
+	"today_runtime": 600,
+}
+
+// Result returns a handler always answering with the given result.
+func Result(result interface{}) Handler {
+	return func(json.RawMessage) (interface{}, protocol.ErrorCode) {
+		return result, protocol.ErrorCodeSuccess
+	}
+}
+
+func (d *Device) getDeviceInfo(json.RawMessage) (interface{}, protocol.ErrorCode) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	info := make(map[string]interface{}, len(d.info))
+
+	for key, value := range d.info {
+		info[key] = value
+	}
+
+	return info, protocol.ErrorCodeSuccess
+}
+
+func (d *Device) setDeviceInfo(params json.RawMessage) (interface{}, protocol.ErrorCode) {
+	var info map[string]interface{}
+
+	if err := json.Unmarshal(params, &info); err != nil || len(info) == 0 {
+		return nil, protocol.ErrorCodeInvalidParams
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for key, value := range info {
+		d.info[key] = value
+	}
+
+	return map[string]interface{}{}, protocol.ErrorCodeSuccess
+}
+
+// Address returns the host and port of the device.
+func (d *Device) Address() string {
+	if d.listener != nil {
+		return d.listener.Addr().String()
+	}
+
+	return strings.TrimPrefix(strings.TrimPrefix(d.Server.URL, "http://"), "https://")
+}
+
+// Config returns a device config for the device with its credentials.
+func (d *Device) Config() *model.DeviceConfig {
+	credentials := d.Credentials
+
+	return &model.DeviceConfig{
+		Address:     d.Address(),
+		Credentials: &credentials,
+	}
+}
+
+func (d *Device) Close() {
+	if d.listener != nil {
+		d.listener.Close()
+		return
+	}
+
+	d.Server.Close()
+}
+
+// Handle sets the handler of a method, replacing an existing one.
+func (d *Device) Handle(method string, handler Handler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.handlers[method] = handler
+}
+
+// InjectFault adds a fault, the first matching fault fails a request.
+func (d *Device) InjectFault(fault Fault) {
+	d.faults.add(fault)
+}
+
+// ClearFaults removes all faults.
+func (d *Device) ClearFaults() {
+	d.faults.clear()
+}
+
+// AddChild adds a child answering control_child requests with the given
+// device id, like the outlets of a power strip. Only the handlers, faults
+// and MultipleRequest of the child are used.
+func (d *Device) AddChild(deviceId string, child *Device) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.children[deviceId] = child
+}
+
+// ExpireSessions drops all sessions, as a device does when rebooted.
+func (d *Device) ExpireSessions() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.sessions = make(map[string]*session)
+	d.klapSessions = make(map[string]*klapSession)
+	d.tokens = make(map[string]bool)
+}
+
+// Calls returns how many times the method was requested, including
+// "handshake" and "login_device", or "handshake1" and "handshake2" for
+// KLAP.
+func (d *Device) Calls(method string) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.calls[method]
+}
+
+type request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type response struct {
+	ErrorCode protocol.ErrorCode `json:"error_code"`
+	Result    interface{}        `json:"result,omitempty"`
+}
+
+func (d *Device) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/app" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req request
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeJsonDecodeFailed})
+		return
+	}
+
+	d.count(req.Method)
+
+	if fault := d.faults.match(req.Method); fault != nil {
+		if fault.StatusCode != 0 {
+			w.WriteHeader(fault.StatusCode)
+		} else {
+			writeJSON(w, &response{ErrorCode: fault.ErrorCode})
+		}
+
+		return
+	}
+
+	switch req.Method {
+	case "handshake":
+		d.handshake(w, req.Params)
+	case "securePassthrough":
+		d.passthrough(w, r, req.Params)
+	default:
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeUnknownMethod})
+	}
+}
+
+func (d *Device) count(method string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.calls[method]++
+}
+
+// faults are the faults of a device or a cloud, each with its own lock
+// since a cloud request also takes the faults of the device.
+type faults struct {
+	lock   sync.Mutex
+	faults []*Fault
+}
+
+func (f *faults) add(fault Fault) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.faults = append(f.faults, &fault)
+}
+
+func (f *faults) clear() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.faults = nil
+}
+
+// match returns the fault matching the method after its delay, or nil if
+// the request is to be answered.
+func (f *faults) match(method string) *Fault {
+	fault := f.take(method)
+
+	if fault == nil {
+		return nil
+	}
+
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+
+	if fault.StatusCode == 0 && fault.ErrorCode == 0 {
+		return nil
+	}
+
+	return fault
+}
+
+func (f *faults) take(method string) *Fault {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, fault := range f.faults {
+		if fault.Method != "" && fault.Method != method {
+			continue
+		}
+
+		if fault.Times > 0 {
+			if fault.Times--; fault.Times == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+		}
+
+		return fault
+	}
+
+	return nil
+}
+
+func (d *Device) handshake(w http.ResponseWriter, params json.RawMessage) {
+	var p struct {
+		Key string `json:"key"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeInvalidParams})
+		return
+	}
+
+	block, _ := pem.Decode([]byte(p.Key))
+
+	if block == nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeInvalidParams})
+		return
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	key, ok := parsed.(*rsa.PublicKey)
+
+	if err != nil || !ok {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeInvalidParams})
+		return
+	}
+
+	keyAndIv := make([]byte, 32)
+	rand.Read(keyAndIv)
+
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, key, keyAndIv)
+
+	if err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeHandshakeFailed})
+		return
+	}
+
+	cipherBlock, _ := aes.NewCipher(keyAndIv[:16])
+
+	id := randomHex(16)
+
+	d.lock.Lock()
+	d.sessions[id] = &session{
+		block:   cipherBlock,
+		iv:      keyAndIv[16:],
+		created: time.Now(),
+	}
+	d.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id})
+	http.SetCookie(w, &http.Cookie{Name: "TIMEOUT", Value: "86400"})
+
+	writeJSON(w, &response{
+		Result: map[string]string{
+			"key": base64.StdEncoding.EncodeToString(encrypted),
+		},
+	})
+}
+
+// session returns the session of the request, nil if it is unknown or
+// expired.
+func (d *Device) session(r *http.Request) *session {
+	cookie, err := r.Cookie(sessionCookie)
+
+	if err != nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	s, ok := d.sessions[cookie.Value]
+
+	if !ok {
+		return nil
+	}
+
+	if d.SessionTimeout > 0 && time.Since(s.created) > d.SessionTimeout {
+		delete(d.sessions, cookie.Value)
+		return nil
+	}
+
+	return s
+}
+
+func (d *Device) passthrough(w http.ResponseWriter, r *http.Request, params json.RawMessage) {
+	s := d.session(r)
+
+	if s == nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeSessionExpired})
+		return
+	}
+
+	var p struct {
+		Request string `json:"request"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeInvalidParams})
+		return
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(p.Request)
+
+	if err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeAesDecodeFailed})
+		return
+	}
+
+	decrypted, err := s.decrypt(encrypted)
+
+	if err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeAesDecodeFailed})
+		return
+	}
+
+	var req request
+
+	if err := json.Unmarshal(decrypted, &req); err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeJsonDecodeFailed})
+		return
+	}
+
+	d.count(req.Method)
+
+	var res *response
+
+	if fault := d.faults.match(req.Method); fault != nil {
+		if fault.StatusCode != 0 {
+			w.WriteHeader(fault.StatusCode)
+			return
+		}
+
+		res = &response{ErrorCode: fault.ErrorCode}
+	} else if req.Method == "login_device" {
+		res = d.login(s, req.Params)
+	} else if token := r.URL.Query().Get("token"); token == "" || token != s.token {
+		res = &response{ErrorCode: protocol.ErrorCodeSessionExpired}
+	} else {
+		res = d.dispatch(req)
+	}
+
+	marshalled, err := json.Marshal(res)
+
+	if err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeJsonEncodeFailed})
+		return
+	}
+
+	writeJSON(w, &response{
+		Result: map[string]string{
+			"response": base64.StdEncoding.EncodeToString(s.encrypt(marshalled)),
+		},
+	})
+}
+
+func (d *Device) login(s *session, params json.RawMessage) *response {
+	var p struct {
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		Password2 string `json:"password2"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidParams}
+	}
+
+	var ok bool
+
+	if p.Username == encodeHash(d.Credentials.Username) {
+		switch {
+		case p.Password2 != "" && d.LoginVersion != 1:
+			ok = p.Password2 == d.hashedPassword()
+		case p.Password != "" && d.LoginVersion != 2:
+			ok = p.Password == base64.StdEncoding.EncodeToString([]byte(d.Credentials.Password))
+		}
+	}
+
+	if !ok {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidCredentials}
+	}
+
+	d.lock.Lock()
+	s.token = randomHex(16)
+	d.lock.Unlock()
+
+	return &response{
+		Result: map[string]string{
+			"token": s.token,
+		},
+	}
+}
+
+func (d *Device) hashedPassword() string {
+	if d.Credentials.HashedPassword != "" {
+		return base64.StdEncoding.EncodeToString([]byte(d.Credentials.HashedPassword))
+	}
+
+	return encodeHash(d.Credentials.Password)
+}
+
+// dispatch answers an authorized request.
+func (d *Device) dispatch(req request) *response {
+	switch req.Method {
+	case "multipleRequest":
+		return d.multipleRequest(req.Params)
+	case "control_child":
+		return d.controlChild(req.Params)
+	default:
+		return d.handle(req)
+	}
+}
+
+// controlChild relays the request to the child, a single request or a
+// multipleRequest.
+func (d *Device) controlChild(params json.RawMessage) *response {
+	var p struct {
+		DeviceId    string  `json:"device_id"`
+		RequestData request `json:"requestData"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidParams}
+	}
+
+	d.lock.Lock()
+	child, ok := d.children[p.DeviceId]
+	d.lock.Unlock()
+
+	if !ok {
+		return &response{ErrorCode: protocol.ErrorCodeDevice}
+	}
+
+	child.count(p.RequestData.Method)
+
+	var res *response
+
+	if fault := child.faults.match(p.RequestData.Method); fault != nil && fault.ErrorCode != 0 {
+		res = &response{ErrorCode: fault.ErrorCode}
+	} else if p.RequestData.Method == "multipleRequest" {
+		res = child.multipleRequest(p.RequestData.Params)
+	} else {
+		res = child.handle(p.RequestData)
+	}
+
+	return &response{
+		Result: map[string]interface{}{
+			"responseData": res,
+		},
+	}
+}
+
+// multipleRequest answers each request with its handler, failing it if
+// a fault with an error code matches.
+func (d *Device) multipleRequest(params json.RawMessage) *response {
+	if !d.MultipleRequest {
+		return &response{ErrorCode: protocol.ErrorCodeUnknownMethod}
+	}
+
+	var p struct {
+		Requests []request `json:"requests"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidParams}
+	}
+
+	type methodResponse struct {
+		Method string `json:"method"`
+		response
+	}
+
+	responses := make([]methodResponse, 0, len(p.Requests))
+
+	for _, inner := range p.Requests {
+		d.count(inner.Method)
+
+		res := &response{}
+
+		if fault := d.faults.match(inner.Method); fault != nil && fault.ErrorCode != 0 {
+			res.ErrorCode = fault.ErrorCode
+		} else {
+			res = d.handle(inner)
+		}
+
+		responses = append(responses, methodResponse{
+			Method:   inner.Method,
+			response: *res,
+		})
+	}
+
+	return &response{
+		Result: map[string]interface{}{
+			"responses": responses,
+		},
+	}
+}
+
+func (d *Device) handle(req request) *response {
+	d.lock.Lock()
+	handler, ok := d.handlers[req.Method]
+	d.lock.Unlock()
+
+	if !ok {
+		return &response{ErrorCode: protocol.ErrorCodeUnknownMethod}
+	}
+
+	result, code := handler(req.Params)
+
+	if code != protocol.ErrorCodeSuccess {
+		return &response{ErrorCode: code}
+	}
+
+	return &response{Result: result}
+}
+
+func (s *session) encrypt(data []byte) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(s.block, s.iv).CryptBlocks(encrypted, padded)
+
+	return encrypted
+}
+
+func (s *session) decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length %d", len(data))
+	}
+
+	decrypted := make([]byte, len(data))
+	cipher.NewCBCDecrypter(s.block, s.iv).CryptBlocks(decrypted, data)
+
+	padding := int(decrypted[len(decrypted)-1])
+
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func encodeHash(value string) string {
+	sum := sha1.Sum([]byte(value))
+
+	return base64.StdEncoding.EncodeToString([]byte(hex.EncodeToString(sum[:])))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
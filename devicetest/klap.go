@@ -0,0 +1,326 @@
+package devicetest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+type klapSession struct {
+	localSeed  []byte
+	remoteSeed []byte
+	authHash   []byte
+
+	// set once handshake2 proved the client knows the credentials
+	block     cipher.Block
+	iv        []byte
+	signature []byte
+
+	created time.Time
+}
+
+// NewKlapDevice starts a fake device speaking the KLAP protocol of newer
+// plug firmware, answering like NewDevice. LoginVersion 1 makes it use
+// the older md5 auth hash, the sha256 one is used otherwise.
+func NewKlapDevice(credentials model.Credentials) *Device {
+	d := newDevice(credentials)
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serveKlap))
+
+	return d
+}
+
+func (d *Device) serveKlap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	var operation string
+
+	switch r.URL.Path {
+	case "/app/handshake1":
+		operation = "handshake1"
+	case "/app/handshake2":
+		operation = "handshake2"
+	case "/app/request":
+		operation = "request"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	d.count(operation)
+
+	if fault := d.faults.match(operation); fault != nil {
+		// KLAP has no error codes outside of requests, any fault fails
+		// with a status
+		status := fault.StatusCode
+
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+
+		w.WriteHeader(status)
+		return
+	}
+
+	switch operation {
+	case "handshake1":
+		d.klapHandshake1(w, body)
+	case "handshake2":
+		d.klapHandshake2(w, r, body)
+	default:
+		d.klapRequest(w, r, body)
+	}
+}
+
+func (d *Device) klapAuthHash() []byte {
+	if d.LoginVersion == 1 {
+		return md5sum(md5sum([]byte(d.Credentials.Username)), md5sum([]byte(d.Credentials.Password)))
+	}
+
+	user := sha1.Sum([]byte(d.Credentials.Username))
+	pass := sha1.Sum([]byte(d.Credentials.Password))
+
+	return sha256Sum(user[:], pass[:])
+}
+
+func (d *Device) klapHandshake1(w http.ResponseWriter, localSeed []byte) {
+	if len(localSeed) != 16 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	remoteSeed := make([]byte, 16)
+	rand.Read(remoteSeed)
+
+	authHash := d.klapAuthHash()
+
+	var serverHash []byte
+
+	if d.LoginVersion == 1 {
+		serverHash = sha256Sum(localSeed, authHash)
+	} else {
+		serverHash = sha256Sum(localSeed, remoteSeed, authHash)
+	}
+
+	id := randomHex(16)
+
+	d.lock.Lock()
+	d.klapSessions[id] = &klapSession{
+		localSeed:  localSeed,
+		remoteSeed: remoteSeed,
+		authHash:   authHash,
+		created:    time.Now(),
+	}
+	d.lock.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id})
+	http.SetCookie(w, &http.Cookie{Name: "TIMEOUT", Value: "86400"})
+
+	w.Write(append(remoteSeed, serverHash...))
+}
+
+func (d *Device) klapHandshake2(w http.ResponseWriter, r *http.Request, payload []byte) {
+	s := d.klapSession(r)
+
+	if s == nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var expected []byte
+
+	if d.LoginVersion == 1 {
+		expected = sha256Sum(s.remoteSeed, s.authHash)
+	} else {
+		expected = sha256Sum(s.remoteSeed, s.localSeed, s.authHash)
+	}
+
+	if !bytes.Equal(payload, expected) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	seeds := append(append(append([]byte{}, s.localSeed...), s.remoteSeed...), s.authHash...)
+
+	block, _ := aes.NewCipher(sha256Sum([]byte("lsk"), seeds)[:16])
+
+	d.lock.Lock()
+	s.block = block
+	s.iv = sha256Sum([]byte("iv"), seeds)[:12]
+	s.signature = sha256Sum([]byte("ldk"), seeds)[:28]
+	d.lock.Unlock()
+}
+
+// klapSession returns the session of the request, nil if it is unknown
+// or expired.
+func (d *Device) klapSession(r *http.Request) *klapSession {
+	cookie, err := r.Cookie(sessionCookie)
+
+	if err != nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	s, ok := d.klapSessions[cookie.Value]
+
+	if !ok {
+		return nil
+	}
+
+	if d.SessionTimeout > 0 && time.Since(s.created) > d.SessionTimeout {
+		delete(d.klapSessions, cookie.Value)
+		return nil
+	}
+
+	return s
+}
+
+func (d *Device) klapRequest(w http.ResponseWriter, r *http.Request, payload []byte) {
+	s := d.klapSession(r)
+
+	d.lock.Lock()
+	established := s != nil && s.block != nil
+	d.lock.Unlock()
+
+	// devices refuse requests of unknown sessions
+	if !established {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	seq, err := strconv.ParseInt(r.URL.Query().Get("seq"), 10, 32)
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	decrypted, err := s.decrypt(payload, int32(seq))
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var req request
+	var res *response
+
+	if err := json.Unmarshal(decrypted, &req); err != nil {
+		res = &response{ErrorCode: protocol.ErrorCodeJsonDecodeFailed}
+	} else {
+		d.count(req.Method)
+
+		if fault := d.faults.match(req.Method); fault != nil {
+			if fault.StatusCode != 0 {
+				w.WriteHeader(fault.StatusCode)
+				return
+			}
+
+			res = &response{ErrorCode: fault.ErrorCode}
+		} else {
+			res = d.dispatch(req)
+		}
+	}
+
+	marshalled, err := json.Marshal(res)
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(s.encrypt(marshalled, int32(seq)))
+}
+
+func (s *klapSession) ivForSeq(seq int32) []byte {
+	iv := make([]byte, 16)
+	copy(iv, s.iv)
+	binary.BigEndian.PutUint32(iv[12:], uint32(seq))
+
+	return iv
+}
+
+func (s *klapSession) sign(seq int32, ciphertext []byte) []byte {
+	seqBytes := binary.BigEndian.AppendUint32(nil, uint32(seq))
+
+	return sha256Sum(s.signature, seqBytes, ciphertext)
+}
+
+func (s *klapSession) encrypt(data []byte, seq int32) []byte {
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	padded := append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(s.block, s.ivForSeq(seq)).CryptBlocks(ciphertext, padded)
+
+	return append(s.sign(seq, ciphertext), ciphertext...)
+}
+
+func (s *klapSession) decrypt(data []byte, seq int32) ([]byte, error) {
+	if len(data) <= sha256.Size || (len(data)-sha256.Size)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid ciphertext length %d", len(data))
+	}
+
+	ciphertext := data[sha256.Size:]
+
+	if !bytes.Equal(data[:sha256.Size], s.sign(seq, ciphertext)) {
+		return nil, fmt.Errorf("invalid signature for seq %d", seq)
+	}
+
+	decrypted := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(s.block, s.ivForSeq(seq)).CryptBlocks(decrypted, ciphertext)
+
+	padding := int(decrypted[len(decrypted)-1])
+
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("invalid padding")
+	}
+
+	return decrypted[:len(decrypted)-padding], nil
+}
+
+func sha256Sum(parts ...[]byte) []byte {
+	h := sha256.New()
+
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	return h.Sum(nil)
+}
+
+func md5sum(parts ...[]byte) []byte {
+	h := md5.New()
+
+	for _, p := range parts {
+		h.Write(p)
+	}
+
+	return h.Sum(nil)
+}
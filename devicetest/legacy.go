@@ -0,0 +1,334 @@
+package devicetest
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// legacy error codes of modules and methods a device doesn't know, and
+// of children it doesn't have
+const (
+	legacyModuleNotSupported = -1
+	legacyMethodNotSupported = -2
+	legacyEntryNotExist      = -14
+)
+
+// legacyMethod is a legacy method answered by the handler of a SMART
+// method, so handlers and faults work the same for every fake.
+type legacyMethod struct {
+	method    string
+	mapParams func(params json.RawMessage) json.RawMessage
+	mapResult func(result interface{}) map[string]interface{}
+}
+
+var legacyMethods = map[string]map[string]legacyMethod{
+	"system": {
+		"get_sysinfo":     {"get_device_info", nil, legacySysInfo},
+		"set_relay_state": {"set_device_info", legacyRelayState, nil},
+	},
+	"emeter": {
+		"get_realtime": {"get_energy_usage", nil, legacyRealtime},
+	},
+}
+
+// NewLegacyDevice starts a fake device speaking the XOR protocol of older
+// Kasa devices over TCP. The legacy methods get_sysinfo, set_relay_state
+// and get_realtime are answered by the handlers of get_device_info,
+// set_device_info and get_energy_usage, and faults and calls use these
+// names too. Faults with a status close the connection without an
+// answer. Legacy devices have no sessions or credentials.
+//
+// Children added with AddChild are listed in the sysinfo, as the outlets
+// of a strip, and answer the queries addressing them in their context.
+// The info of a child is read from its get_device_info handler.
+func NewLegacyDevice() *Device {
+	d := newDevice(model.Credentials{})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		panic("devicetest: failed to listen: " + err.Error())
+	}
+
+	d.listener = listener
+
+	go d.serveLegacy()
+
+	return d
+}
+
+func (d *Device) serveLegacy() {
+	for {
+		conn, err := d.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go d.serveLegacyConn(conn)
+	}
+}
+
+func (d *Device) serveLegacyConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		header := make([]byte, 4)
+
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		body := make([]byte, binary.BigEndian.Uint32(header))
+
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+
+		var query map[string]map[string]json.RawMessage
+
+		if err := json.Unmarshal(protocol.XorDecrypt(body), &query); err != nil {
+			return
+		}
+
+		res, ok := d.legacyQuery(query)
+
+		if !ok {
+			return
+		}
+
+		marshalled, err := json.Marshal(res)
+
+		if err != nil {
+			return
+		}
+
+		frame := binary.BigEndian.AppendUint32(nil, uint32(len(marshalled)))
+
+		if _, err := conn.Write(append(frame, protocol.XorEncrypt(marshalled)...)); err != nil {
+			return
+		}
+	}
+}
+
+// legacyQuery answers every method of every module in the query, it
+// returns false if a fault drops the connection.
+func (d *Device) legacyQuery(query map[string]map[string]json.RawMessage) (map[string]map[string]interface{}, bool) {
+	res := make(map[string]map[string]interface{}, len(query))
+
+	// the context addresses a child, which answers everything but the
+	// sysinfo of the strip
+	target := d
+
+	if context, ok := query["context"]; ok {
+		delete(query, "context")
+
+		var ids []string
+		json.Unmarshal(context["child_ids"], &ids)
+
+		d.lock.Lock()
+		child, ok := d.children[firstOf(ids)]
+		d.lock.Unlock()
+
+		if !ok {
+			for module := range query {
+				res[module] = map[string]interface{}{
+					"err_code": legacyEntryNotExist,
+					"err_msg":  "entry not exist",
+				}
+			}
+
+			return res, true
+		}
+
+		target = child
+	}
+
+	for module, methods := range query {
+		known, ok := legacyMethods[module]
+
+		if !ok {
+			res[module] = map[string]interface{}{
+				"err_code": legacyModuleNotSupported,
+				"err_msg":  "module not support",
+			}
+
+			continue
+		}
+
+		res[module] = make(map[string]interface{}, len(methods))
+
+		for method, params := range methods {
+			m, ok := known[method]
+
+			if !ok {
+				res[module][method] = map[string]interface{}{
+					"err_code": legacyMethodNotSupported,
+					"err_msg":  "member not support",
+				}
+
+				continue
+			}
+
+			device := target
+
+			if m.method == "get_device_info" {
+				device = d
+			}
+
+			device.count(m.method)
+
+			if fault := device.faults.match(m.method); fault != nil {
+				if fault.StatusCode != 0 {
+					return nil, false
+				}
+
+				res[module][method] = map[string]interface{}{"err_code": fault.ErrorCode}
+				continue
+			}
+
+			if m.mapParams != nil {
+				params = m.mapParams(params)
+			}
+
+			result := legacyResult(device.handle(request{Method: m.method, Params: params}), m.mapResult)
+
+			if m.method == "get_device_info" && result["err_code"] == 0 {
+				if children := d.legacyChildren(); len(children) > 0 {
+					result["children"] = children
+					result["child_num"] = len(children)
+				}
+			}
+
+			res[module][method] = result
+		}
+	}
+
+	return res, true
+}
+
+// legacyChildren lists the children as the outlets in the sysinfo of a
+// strip, ordered by id.
+func (d *Device) legacyChildren() []map[string]interface{} {
+	d.lock.Lock()
+	ids := make([]string, 0, len(d.children))
+	children := make(map[string]*Device, len(d.children))
+
+	for id, child := range d.children {
+		ids = append(ids, id)
+		children[id] = child
+	}
+	d.lock.Unlock()
+
+	sort.Strings(ids)
+
+	outlets := make([]map[string]interface{}, 0, len(ids))
+
+	for _, id := range ids {
+		sysinfo := legacySysInfo(children[id].handle(request{Method: "get_device_info"}).Result)
+
+		outlets = append(outlets, map[string]interface{}{
+			"id":      id,
+			"alias":   sysinfo["alias"],
+			"state":   sysinfo["relay_state"],
+			"on_time": sysinfo["on_time"],
+		})
+	}
+
+	return outlets
+}
+
+func firstOf(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+
+	return ids[0]
+}
+
+// legacyResult maps a SMART response to the legacy result, which carries
+// the error code along with the fields.
+func legacyResult(res *response, mapResult func(result interface{}) map[string]interface{}) map[string]interface{} {
+	if res.ErrorCode != protocol.ErrorCodeSuccess {
+		return map[string]interface{}{"err_code": res.ErrorCode}
+	}
+
+	result := map[string]interface{}{}
+
+	if mapResult != nil {
+		result = mapResult(res.Result)
+	}
+
+	result["err_code"] = 0
+
+	return result
+}
+
+// legacySysInfo maps the device info to the sysinfo of a legacy plug,
+// keeping the values as they are so malformed results stay malformed.
+func legacySysInfo(result interface{}) map[string]interface{} {
+	info, _ := result.(map[string]interface{})
+
+	sysinfo := map[string]interface{}{}
+
+	for key, legacyKey := range map[string]string{
+		"device_id": "deviceId",
+		"model":     "model",
+		"type":      "type",
+		"rssi":      "rssi",
+		"on_time":   "on_time",
+		"sw_ver":    "sw_ver",
+		"hw_ver":    "hw_ver",
+		"mac":       "mac",
+	} {
+		if value, ok := info[key]; ok {
+			sysinfo[legacyKey] = value
+		}
+	}
+
+	if on, ok := info["device_on"].(bool); ok {
+		sysinfo["relay_state"] = 0
+
+		if on {
+			sysinfo["relay_state"] = 1
+		}
+	}
+
+	// legacy devices report the alias as is
+	if nickname, ok := info["nickname"].(string); ok {
+		if alias, err := base64.StdEncoding.DecodeString(nickname); err == nil {
+			sysinfo["alias"] = string(alias)
+		}
+	}
+
+	return sysinfo
+}
+
+func legacyRealtime(result interface{}) map[string]interface{} {
+	usage, _ := result.(map[string]interface{})
+
+	return map[string]interface{}{
+		"power_mw": usage["current_power"],
+	}
+}
+
+// legacyRelayState maps the relay state to the device_on param of
+// set_device_info.
+func legacyRelayState(params json.RawMessage) json.RawMessage {
+	var p struct {
+		State int `json:"state"`
+	}
+
+	json.Unmarshal(params, &p)
+
+	marshalled, _ := json.Marshal(map[string]bool{"device_on": p.State == 1})
+
+	return marshalled
+}
@@ -0,0 +1,174 @@
+package devicetest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// NewTLSDevice starts a fake device speaking the HTTPS API of newer
+// firmware with a self-signed certificate, answering like NewDevice.
+func NewTLSDevice(credentials model.Credentials) *Device {
+	d := newDevice(credentials)
+	d.Server = httptest.NewUnstartedServer(http.HandlerFunc(d.serveTLS))
+	d.Server.TLS = &tls.Config{GetConfigForClient: d.tlsConfig}
+	d.Server.StartTLS()
+
+	return d
+}
+
+// Fingerprint returns the fingerprint of the certificate of a TLS device,
+// as pinned by the TLS transport.
+func (d *Device) Fingerprint() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.certificate != nil {
+		return protocol.CertificateFingerprint(d.certificate.Leaf)
+	}
+
+	return protocol.CertificateFingerprint(d.Server.Certificate())
+}
+
+// RotateCertificate makes a TLS device present a new self-signed
+// certificate on new connections, as it does after a factory reset.
+func (d *Device) RotateCertificate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "devicetest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	d.certificate = &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	d.lock.Unlock()
+
+	return nil
+}
+
+// tlsConfig serves the rotated certificate, if any.
+func (d *Device) tlsConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.certificate == nil {
+		return nil, nil
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{*d.certificate}}, nil
+}
+
+func (d *Device) serveTLS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/app" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req request
+
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeJsonDecodeFailed})
+		return
+	}
+
+	d.count(req.Method)
+
+	if fault := d.faults.match(req.Method); fault != nil {
+		if fault.StatusCode != 0 {
+			w.WriteHeader(fault.StatusCode)
+		} else {
+			writeJSON(w, &response{ErrorCode: fault.ErrorCode})
+		}
+
+		return
+	}
+
+	if req.Method == "login" {
+		writeJSON(w, d.tlsLogin(req.Params))
+		return
+	}
+
+	d.lock.Lock()
+	valid := d.tokens[r.URL.Query().Get("token")]
+	d.lock.Unlock()
+
+	if !valid {
+		writeJSON(w, &response{ErrorCode: protocol.ErrorCodeSessionExpired})
+		return
+	}
+
+	writeJSON(w, d.dispatch(req))
+}
+
+func (d *Device) tlsLogin(params json.RawMessage) *response {
+	var p struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Hashed   bool   `json:"hashed"`
+	}
+
+	if err := json.Unmarshal(params, &p); err != nil {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidParams}
+	}
+
+	sum := md5.Sum([]byte(d.Credentials.Password))
+
+	if !p.Hashed || p.Username != d.Credentials.Username || p.Password != strings.ToUpper(hex.EncodeToString(sum[:])) {
+		return &response{ErrorCode: protocol.ErrorCodeInvalidCredentials}
+	}
+
+	token := randomHex(16)
+
+	d.lock.Lock()
+	d.tokens[token] = true
+	d.lock.Unlock()
+
+	return &response{
+		Result: map[string]string{
+			"token": token,
+		},
+	}
+}
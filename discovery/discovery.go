@@ -0,0 +1,409 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+const (
+	DefaultTarget  = "255.255.255.255"
+	DefaultPort    = 20002
+	DefaultTimeout = 3 * time.Second
+
+	// EncryptTypeXor marks devices found with the legacy broadcast
+	EncryptTypeXor = "XOR"
+
+	headerSize = 16
+	initialCrc = 0x5A6B7C8D
+
+	// the query is sent a few times as UDP gives no delivery guarantees
+	queryAttempts = 3
+
+	legacyQuery = `{"system":{"get_sysinfo":{}}}`
+)
+
+type Result struct {
+	DeviceId       string `json:"device_id"`
+	Owner          string `json:"owner"`
+	DeviceType     string `json:"device_type"`
+	Model          string `json:"device_model"`
+	IP             string `json:"ip"`
+	MAC            string `json:"mac"`
+	FactoryDefault bool   `json:"factory_default"`
+
+	EncryptType    string `json:"encrypt_type"`
+	LoginVersion   int    `json:"login_version"`
+	HttpPort       int    `json:"http_port"`
+	IsSupportHttps bool   `json:"is_support_https"`
+
+	// DecryptedData holds the encrypted part of the reply, if the device
+	// sent one, decrypted with our key.
+	DecryptedData map[string]interface{} `json:"decrypted_data,omitempty"`
+}
+
+// Transport returns the name of the protocol transport matching the
+// encryption type advertised by the device.
+func (r *Result) Transport() string {
+	switch strings.ToUpper(r.EncryptType) {
+	case "KLAP":
+		return protocol.TransportKlap
+	case "AES":
+		return protocol.TransportAes
+	case EncryptTypeXor:
+		return protocol.TransportLegacy
+	default:
+		return ""
+	}
+}
+
+type discoveryResponse struct {
+	protocol.AesProtoBaseResponse
+	Result struct {
+		DeviceId       string `json:"device_id"`
+		Owner          string `json:"owner"`
+		DeviceType     string `json:"device_type"`
+		Model          string `json:"device_model"`
+		IP             string `json:"ip"`
+		MAC            string `json:"mac"`
+		FactoryDefault bool   `json:"factory_default"`
+		EncryptScheme  struct {
+			IsSupportHttps bool   `json:"is_support_https"`
+			EncryptType    string `json:"encrypt_type"`
+			HttpPort       int    `json:"http_port"`
+			LoginVersion   int    `json:"lv"`
+		} `json:"mgt_encrypt_schm"`
+		EncryptInfo *struct {
+			Scheme string `json:"sym_schm"`
+			Key    string `json:"key"`
+			Data   string `json:"data"`
+		} `json:"encrypt_info"`
+	} `json:"result"`
+}
+
+type Discoverer struct {
+	key *rsa.PrivateKey
+
+	Target string
+	Port   int
+
+	// LegacyPort is where older Kasa devices listen for the XOR
+	// encrypted broadcast, zero disables the legacy discovery.
+	LegacyPort int
+
+	Timeout time.Duration
+}
+
+func NewDiscoverer(key *rsa.PrivateKey) *Discoverer {
+	return &Discoverer{
+		key:        key,
+		Target:     DefaultTarget,
+		Port:       DefaultPort,
+		LegacyPort: protocol.LegacyPort,
+		Timeout:    DefaultTimeout,
+	}
+}
+
+func (d *Discoverer) Discover() ([]*Result, error) {
+	return d.DiscoverContext(context.Background())
+}
+
+// DiscoverContext broadcasts the discovery queries and collects replies
+// until the timeout passes, or fails once the context is done. Devices
+// answering both queries are reported once.
+func (d *Discoverer) DiscoverContext(ctx context.Context) ([]*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	query, err := d.query()
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	if err := d.broadcast(conn, d.Port, query); err != nil {
+		return nil, err
+	}
+
+	if d.LegacyPort != 0 {
+		if err := d.broadcast(conn, d.LegacyPort, protocol.XorEncrypt([]byte(legacyQuery))); err != nil {
+			return nil, err
+		}
+	}
+
+	deadline := time.Now().Add(d.Timeout)
+
+	if limit, ok := ctx.Deadline(); ok && limit.Before(deadline) {
+		deadline = limit
+	}
+
+	conn.SetReadDeadline(deadline)
+
+	// unblock the read as soon as the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var results []*Result
+	seen := make(map[string]int)
+	buf := make([]byte, 4096)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+
+		if err != nil {
+			var netErr net.Error
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, err
+		}
+
+		var result *Result
+
+		if d.LegacyPort != 0 && addr.Port == d.LegacyPort {
+			result, err = d.parseLegacy(buf[:n])
+		} else {
+			result, err = d.parse(buf[:n])
+		}
+
+		if err != nil {
+			logger.Debug("msg", "ignoring invalid discovery reply", "from", addr, "err", err)
+			continue
+		}
+
+		if result.IP == "" {
+			result.IP = addr.IP.String()
+		}
+
+		id := result.MAC
+		if id == "" {
+			id = result.IP
+		}
+
+		if i, ok := seen[id]; ok {
+			// the newer reply carries the encryption details, prefer it
+			if results[i].EncryptType == EncryptTypeXor && result.EncryptType != EncryptTypeXor {
+				results[i] = result
+			}
+			continue
+		}
+
+		seen[id] = len(results)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (d *Discoverer) broadcast(conn *net.UDPConn, port int, query []byte) error {
+	target, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(d.Target, fmt.Sprint(port)))
+
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("msg", "sending discovery query", "target", target)
+
+	for i := 0; i < queryAttempts; i++ {
+		if _, err := conn.WriteToUDP(query, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// query builds the discovery packet: a 16 byte header followed by our
+// public key, which newer firmware uses to encrypt parts of the reply.
+func (d *Discoverer) query() ([]byte, error) {
+	encoded, err := x509.MarshalPKIXPublicKey(&d.key.PublicKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pubKeyPem := new(bytes.Buffer)
+	pem.Encode(pubKeyPem, &pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: encoded,
+	})
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"params": map[string]string{
+			"rsa_key": pubKeyPem.String(),
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	serial := make([]byte, 4)
+
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+
+	query := make([]byte, headerSize, headerSize+len(payload))
+	query[0] = 2                                                // version
+	query[1] = 0                                                // message type
+	binary.BigEndian.PutUint16(query[2:], 1)                    // op code
+	binary.BigEndian.PutUint16(query[4:], uint16(len(payload))) // message size
+	query[6] = 17                                               // flags
+	query[7] = 0                                                // padding
+	copy(query[8:], serial)
+	binary.BigEndian.PutUint32(query[12:], initialCrc)
+	query = append(query, payload...)
+
+	binary.BigEndian.PutUint32(query[12:], crc32.ChecksumIEEE(query))
+
+	return query, nil
+}
+
+func (d *Discoverer) parse(data []byte) (*Result, error) {
+	if len(data) <= headerSize {
+		return nil, fmt.Errorf("reply too short (%d bytes)", len(data))
+	}
+
+	var response discoveryResponse
+
+	if err := json.Unmarshal(data[headerSize:], &response); err != nil {
+		return nil, err
+	}
+
+	if response.ErrorCode != 0 {
+		return nil, fmt.Errorf("discovery failed with error code %d", response.ErrorCode)
+	}
+
+	info := response.Result
+
+	result := &Result{
+		DeviceId:       info.DeviceId,
+		Owner:          info.Owner,
+		DeviceType:     info.DeviceType,
+		Model:          info.Model,
+		IP:             info.IP,
+		MAC:            normalizeMAC(info.MAC),
+		FactoryDefault: info.FactoryDefault,
+		EncryptType:    info.EncryptScheme.EncryptType,
+		LoginVersion:   info.EncryptScheme.LoginVersion,
+		HttpPort:       info.EncryptScheme.HttpPort,
+		IsSupportHttps: info.EncryptScheme.IsSupportHttps,
+	}
+
+	if info.EncryptInfo != nil && info.EncryptInfo.Data != "" {
+		decrypted, err := d.decrypt(info.EncryptInfo.Key, info.EncryptInfo.Data)
+
+		if err != nil {
+			logger.Debug("msg", "unable to decrypt discovery data", "ip", result.IP, "err", err)
+		} else {
+			result.DecryptedData = decrypted
+		}
+	}
+
+	return result, nil
+}
+
+// decrypt decodes the encrypted part of a reply, which uses the same
+// RSA wrapped AES key and IV as the securePassthrough handshake.
+func (d *Discoverer) decrypt(key, data string) (map[string]interface{}, error) {
+	session, err := protocol.NewAesEncryptedSession(key, d.key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted data length %d", len(encrypted))
+	}
+
+	decrypted, err := session.Decrypt(encrypted)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result map[string]interface{}
+
+	if err := json.Unmarshal(decrypted, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// parseLegacy decodes a reply to the XOR encrypted get_sysinfo broadcast,
+// which unlike the TCP protocol carries no length prefix.
+func (d *Discoverer) parseLegacy(data []byte) (*Result, error) {
+	var response protocol.LegacySysInfoResponse
+
+	if err := json.Unmarshal(protocol.XorDecrypt(data), &response); err != nil {
+		return nil, err
+	}
+
+	info := response.System.SysInfo
+
+	if info.ErrorCode != 0 {
+		return nil, fmt.Errorf("discovery failed with error code %d", info.ErrorCode)
+	}
+
+	deviceType := info.Type
+	if deviceType == "" {
+		deviceType = info.MicType
+	}
+
+	mac := info.MAC
+	if mac == "" {
+		mac = info.MicMAC
+	}
+
+	return &Result{
+		DeviceId:    info.DeviceId,
+		DeviceType:  deviceType,
+		Model:       info.Model,
+		MAC:         normalizeMAC(mac),
+		EncryptType: EncryptTypeXor,
+	}, nil
+}
+
+// normalizeMAC formats addresses the same way for both generations, the
+// newer devices separate the octets with dashes.
+func normalizeMAC(mac string) string {
+	return strings.ToUpper(strings.ReplaceAll(mac, "-", ":"))
+}
@@ -0,0 +1,368 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"hash/crc32"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+func newDiscoverer(t *testing.T) *Discoverer {
+	key, err := protocol.GenerateKey(1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewDiscoverer(key)
+}
+
+// publicKey returns the key sent in the query, after checking its header
+// and checksum. It is called by responders, so it fails the test without
+// stopping it.
+func publicKey(t *testing.T, query []byte) *rsa.PublicKey {
+	t.Helper()
+
+	if len(query) <= headerSize {
+		t.Errorf("query too short (%d bytes)", len(query))
+		return nil
+	}
+
+	if query[0] != 2 || binary.BigEndian.Uint16(query[2:]) != 1 {
+		t.Errorf("got version %d and op code %d, expected 2 and 1", query[0], binary.BigEndian.Uint16(query[2:]))
+	}
+
+	if size := int(binary.BigEndian.Uint16(query[4:])); size != len(query)-headerSize {
+		t.Errorf("got message size %d, expected %d", size, len(query)-headerSize)
+	}
+
+	checked := bytes.Clone(query)
+	binary.BigEndian.PutUint32(checked[12:], initialCrc)
+
+	if crc, expected := binary.BigEndian.Uint32(query[12:]), crc32.ChecksumIEEE(checked); crc != expected {
+		t.Errorf("got checksum %08x, expected %08x", crc, expected)
+	}
+
+	var payload struct {
+		Params struct {
+			RsaKey string `json:"rsa_key"`
+		} `json:"params"`
+	}
+
+	if err := json.Unmarshal(query[headerSize:], &payload); err != nil {
+		t.Errorf("invalid query payload: %v", err)
+		return nil
+	}
+
+	block, _ := pem.Decode([]byte(payload.Params.RsaKey))
+
+	if block == nil {
+		t.Errorf("query carries no PEM key")
+		return nil
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+
+	if err != nil {
+		t.Errorf("invalid key in query: %v", err)
+		return nil
+	}
+
+	return key.(*rsa.PublicKey)
+}
+
+// reply builds the reply of a newer device, with data encrypted for the
+// key of the query if given.
+func reply(t *testing.T, result map[string]interface{}, key *rsa.PublicKey, data string) []byte {
+	t.Helper()
+
+	if key != nil {
+		keyAndIv := make([]byte, 32)
+		rand.Read(keyAndIv)
+
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, key, keyAndIv)
+
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+
+		padding := aes.BlockSize - len(data)%aes.BlockSize
+		padded := append([]byte(data), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+		block, _ := aes.NewCipher(keyAndIv[:16])
+		encrypted := make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, keyAndIv[16:]).CryptBlocks(encrypted, padded)
+
+		result["encrypt_info"] = map[string]interface{}{
+			"sym_schm": "AES",
+			"key":      base64.StdEncoding.EncodeToString(encryptedKey),
+			"data":     base64.StdEncoding.EncodeToString(encrypted),
+		}
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"error_code": 0,
+		"result":     result,
+	})
+
+	if err != nil {
+		t.Error(err)
+		return nil
+	}
+
+	return append(make([]byte, headerSize), payload...)
+}
+
+func legacyReply(sysinfo string) []byte {
+	return protocol.XorEncrypt([]byte(`{"system":{"get_sysinfo":` + sysinfo + `}}`))
+}
+
+// respond answers every query received on a loopback port with the
+// replies returned by the handler, and returns the port.
+func respond(t *testing.T, handler func(query []byte) [][]byte) int {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+
+			if err != nil {
+				return
+			}
+
+			for _, reply := range handler(bytes.Clone(buf[:n])) {
+				conn.WriteToUDP(reply, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestQuery(t *testing.T) {
+	d := newDiscoverer(t)
+
+	query, err := d.query()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key := publicKey(t, query); key == nil || !key.Equal(&d.key.PublicKey) {
+		t.Errorf("query carries another key")
+	}
+}
+
+func TestParse(t *testing.T) {
+	d := newDiscoverer(t)
+
+	result := map[string]interface{}{
+		"device_id":    "8022D3E0",
+		"device_type":  "SMART.TAPOPLUG",
+		"device_model": "P110(EU)",
+		"ip":           "192.168.1.20",
+		"mac":          "aa-bb-cc-dd-ee-ff",
+		"mgt_encrypt_schm": map[string]interface{}{
+			"encrypt_type":     "KLAP",
+			"http_port":        80,
+			"lv":               2,
+			"is_support_https": false,
+		},
+	}
+
+	parsed, err := d.parse(reply(t, result, &d.key.PublicKey, `{"nickname":"plug"}`))
+
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := Result{
+		DeviceId:    "8022D3E0",
+		DeviceType:  "SMART.TAPOPLUG",
+		Model:       "P110(EU)",
+		IP:          "192.168.1.20",
+		MAC:         "AA:BB:CC:DD:EE:FF",
+		EncryptType: "KLAP",
+		HttpPort:    80,
+
+		LoginVersion: 2,
+	}
+
+	decrypted := parsed.DecryptedData
+	parsed.DecryptedData = nil
+
+	if !reflect.DeepEqual(*parsed, expected) {
+		t.Errorf("got %+v, expected %+v", *parsed, expected)
+	}
+
+	if decrypted["nickname"] != "plug" {
+		t.Errorf("got decrypted data %v, expected the nickname", decrypted)
+	}
+
+	if transport := parsed.Transport(); transport != protocol.TransportKlap {
+		t.Errorf("got transport %q, expected %q", transport, protocol.TransportKlap)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	d := newDiscoverer(t)
+
+	tests := []struct {
+		name  string
+		reply []byte
+	}{
+		{"empty", nil},
+		{"header only", make([]byte, headerSize)},
+		{"invalid json", append(make([]byte, headerSize), "{"...)},
+		{"error code", append(make([]byte, headerSize), `{"error_code":-1}`...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result, err := d.parse(tt.reply); err == nil {
+				t.Errorf("got %+v, expected an error", result)
+			}
+		})
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	d := newDiscoverer(t)
+
+	result, err := d.parseLegacy(legacyReply(`{"err_code":0,"model":"HS110(EU)","mic_type":"IOT.SMARTPLUGSWITCH","mac":"aa:bb:cc:dd:ee:ff","deviceId":"8006"}`))
+
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := Result{
+		DeviceId:    "8006",
+		DeviceType:  "IOT.SMARTPLUGSWITCH",
+		Model:       "HS110(EU)",
+		MAC:         "AA:BB:CC:DD:EE:FF",
+		EncryptType: EncryptTypeXor,
+	}
+
+	if !reflect.DeepEqual(*result, expected) {
+		t.Errorf("got %+v, expected %+v", *result, expected)
+	}
+
+	if transport := result.Transport(); transport != protocol.TransportLegacy {
+		t.Errorf("got transport %q, expected %q", transport, protocol.TransportLegacy)
+	}
+
+	if _, err := d.parseLegacy(legacyReply(`{"err_code":-1}`)); err == nil {
+		t.Errorf("got no error for a failed reply")
+	}
+}
+
+// TestDiscover discovers a newer device and two legacy devices, one of
+// which is the newer device answering the legacy query as well.
+func TestDiscover(t *testing.T) {
+	d := newDiscoverer(t)
+	d.Target = "127.0.0.1"
+	d.Timeout = 500 * time.Millisecond
+
+	d.Port = respond(t, func(query []byte) [][]byte {
+		return [][]byte{
+			reply(t, map[string]interface{}{
+				"device_id":    "NEW",
+				"device_model": "P110(EU)",
+				"mac":          "AA-BB-CC-DD-EE-FF",
+				"mgt_encrypt_schm": map[string]interface{}{
+					"encrypt_type": "AES",
+					"lv":           2,
+				},
+			}, publicKey(t, query), `{}`),
+		}
+	})
+
+	d.LegacyPort = respond(t, func(query []byte) [][]byte {
+		if string(protocol.XorDecrypt(query)) != legacyQuery {
+			t.Errorf("got legacy query %q", protocol.XorDecrypt(query))
+		}
+
+		return [][]byte{
+			legacyReply(`{"err_code":0,"model":"P110(EU)","mac":"aa:bb:cc:dd:ee:ff","deviceId":"NEW"}`),
+			legacyReply(`{"err_code":0,"model":"HS100(EU)","mac":"11:22:33:44:55:66","deviceId":"OLD"}`),
+			[]byte("garbage"),
+		}
+	})
+
+	results, err := d.Discover()
+
+	if err != nil {
+		t.Fatalf("discover failed: %v", err)
+	}
+
+	// every query is sent several times, devices are reported once
+	if len(results) != 2 {
+		t.Fatalf("got %d results, expected 2", len(results))
+	}
+
+	byId := make(map[string]*Result)
+
+	for _, result := range results {
+		byId[result.DeviceId] = result
+
+		if result.IP != "127.0.0.1" {
+			t.Errorf("got IP %q for %s, expected the address of the reply", result.IP, result.DeviceId)
+		}
+	}
+
+	// the newer reply wins over the legacy one of the same device
+	if result := byId["NEW"]; result == nil || result.EncryptType != "AES" || result.DecryptedData == nil {
+		t.Errorf("got %+v, expected the reply to the newer query", result)
+	}
+
+	if result := byId["OLD"]; result == nil || result.EncryptType != EncryptTypeXor || result.MAC != "11:22:33:44:55:66" {
+		t.Errorf("got %+v, expected the legacy device", result)
+	}
+}
+
+func TestDiscoverCancel(t *testing.T) {
+	d := newDiscoverer(t)
+	d.Target = "127.0.0.1"
+	d.Port = respond(t, func([]byte) [][]byte { return nil })
+	d.LegacyPort = 0
+	d.Timeout = 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	_, err := d.DiscoverContext(ctx)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, expected the discovery to be cancelled", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled discovery returned after %s", elapsed)
+	}
+}
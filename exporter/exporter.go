@@ -1,8 +1,13 @@
 package exporter
 
 import (
+	"context"
+	"errors"
+	"sync"
+
 	"github.com/dehydr8/kasa-go/device"
 	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/protocol"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -13,11 +18,15 @@ type PlugExporter struct {
 
 	metricsUp,
 	metricsRssi,
-	metricsPowerLoad *prometheus.Desc
+	metricsPowerLoad,
+	metricsErrors *prometheus.Desc
+
+	errorsLock sync.Mutex
+	errors     map[protocol.ErrorClass]int
 }
 
-func NewPlugExporter(device *device.Device) (*PlugExporter, error) {
-	info, err := device.GetDeviceInfo()
+func NewPlugExporter(ctx context.Context, device *device.Device) (*PlugExporter, error) {
+	info, err := device.GetDeviceInfo(protocol.WithPriority(ctx, protocol.PriorityBackground))
 
 	if err != nil {
 		return nil, err
@@ -43,21 +52,62 @@ func NewPlugExporter(device *device.Device) (*PlugExporter, error) {
 		metricsRssi: prometheus.NewDesc("kasa_rssi",
 			"Wifi received signal strength indicator",
 			nil, constLabels),
+
+		metricsErrors: prometheus.NewDesc("kasa_errors_total",
+			"Errors talking to the device by class",
+			[]string{"class"}, constLabels),
+
+		errors: make(map[protocol.ErrorClass]int),
 	}
 
 	return e, nil
 }
 
 func (k *PlugExporter) Collect(ch chan<- prometheus.Metric) {
+	k.collect(context.Background(), ch)
+}
+
+// WithContext returns a collector for a single scrape, whose device
+// requests are cancelled along with the context.
+func (k *PlugExporter) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{
+		exporter: k,
+		ctx:      ctx,
+	}
+}
+
+func (k *PlugExporter) collect(ctx context.Context, ch chan<- prometheus.Metric) {
 	logger.Debug("msg", "collecting metrics", "target", k.device.Address())
 
-	if energyUsage, err := k.device.GetEnergyUsage(); err == nil {
+	// scrapes give way to commands sent to the device meanwhile
+	k.collectResults(protocol.WithPriority(ctx, protocol.PriorityBackground), ch)
+
+	k.errorsLock.Lock()
+	defer k.errorsLock.Unlock()
+
+	for class, count := range k.errors {
+		ch <- prometheus.MustNewConstMetric(k.metricsErrors, prometheus.CounterValue, float64(count), class.String())
+	}
+}
+
+func (k *PlugExporter) collectResults(ctx context.Context, ch chan<- prometheus.Metric) {
+	results, err := k.device.Batch(ctx,
+		device.Request{Method: "get_energy_usage"},
+		device.Request{Method: "get_device_info"},
+	)
+
+	if err != nil {
+		k.recordError("error querying device", err)
+		return
+	}
+
+	if energyUsage, err := results.EnergyUsage(); err == nil {
 		ch <- prometheus.MustNewConstMetric(k.metricsPowerLoad, prometheus.GaugeValue, float64(energyUsage.CurrentPower))
 	} else {
-		logger.Warn("msg", "error getting energy usage", "err", err)
+		k.recordError("error getting energy usage", err)
 	}
 
-	if deviceInfo, err := k.device.GetDeviceInfo(); err == nil {
+	if deviceInfo, err := results.DeviceInfo(); err == nil {
 		if deviceInfo.DeviceOn {
 			ch <- prometheus.MustNewConstMetric(k.metricsUp, prometheus.GaugeValue, 1)
 		} else {
@@ -66,12 +116,48 @@ func (k *PlugExporter) Collect(ch chan<- prometheus.Metric) {
 
 		ch <- prometheus.MustNewConstMetric(k.metricsRssi, prometheus.GaugeValue, float64(deviceInfo.Rssi))
 	} else {
-		logger.Warn("msg", "error getting device info", "err", err)
+		k.recordError("error getting device info", err)
+	}
+}
+
+func (k *PlugExporter) recordError(msg string, err error) {
+	// the scrape was cancelled by its client, which says nothing about
+	// the device
+	if errors.Is(err, context.Canceled) {
+		logger.Debug("msg", msg, "target", k.device.Address(), "err", err)
+		return
+	}
+
+	class := protocol.Classify(err)
+
+	if class == protocol.ErrorClassAuthentication {
+		logger.Error("msg", msg, "target", k.device.Address(), "class", class, "err", err)
+	} else {
+		logger.Warn("msg", msg, "target", k.device.Address(), "class", class, "err", err)
 	}
+
+	k.errorsLock.Lock()
+	defer k.errorsLock.Unlock()
+
+	k.errors[class]++
 }
 
 func (k *PlugExporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- k.metricsPowerLoad
 	ch <- k.metricsUp
 	ch <- k.metricsRssi
+	ch <- k.metricsErrors
+}
+
+type contextCollector struct {
+	exporter *PlugExporter
+	ctx      context.Context
+}
+
+func (c *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.collect(c.ctx, ch)
+}
+
+func (c *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.exporter.Describe(ch)
 }
@@ -0,0 +1,212 @@
+package exporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dehydr8/kasa-go/device"
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var credentials = model.Credentials{Username: "user@example.com", Password: "password"}
+
+func newExporter(t *testing.T) (*PlugExporter, *devicetest.Device) {
+	fake := devicetest.NewDevice(credentials)
+	t.Cleanup(fake.Close)
+
+	key, err := protocol.GenerateKey(1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := device.NewDevice(key, fake.Config())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exporter, err := NewPlugExporter(context.Background(), dev)
+
+	if err != nil {
+		t.Fatalf("creating exporter failed: %v", err)
+	}
+
+	return exporter, fake
+}
+
+type sample struct {
+	value  float64
+	labels map[string]string
+}
+
+// scrape collects the exporter and returns the samples by metric name.
+func scrape(t *testing.T, collector prometheus.Collector) map[string][]sample {
+	registry := prometheus.NewPedanticRegistry()
+
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := registry.Gather()
+
+	if err != nil {
+		t.Fatalf("gathering metrics failed: %v", err)
+	}
+
+	samples := make(map[string][]sample)
+
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			s := sample{labels: make(map[string]string)}
+
+			for _, label := range metric.GetLabel() {
+				s.labels[label.GetName()] = label.GetValue()
+			}
+
+			switch {
+			case metric.GetGauge() != nil:
+				s.value = metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				s.value = metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				s.value = float64(metric.GetHistogram().GetSampleCount())
+			}
+
+			samples[family.GetName()] = append(samples[family.GetName()], s)
+		}
+	}
+
+	return samples
+}
+
+func value(t *testing.T, samples map[string][]sample, name string) float64 {
+	t.Helper()
+
+	if len(samples[name]) != 1 {
+		t.Fatalf("got %d samples of %s, expected 1", len(samples[name]), name)
+	}
+
+	return samples[name][0].value
+}
+
+func TestPlugExporterMetrics(t *testing.T) {
+	exporter, _ := newExporter(t)
+
+	samples := scrape(t, exporter)
+
+	if v := value(t, samples, "kasa_power_load"); v != 12345 {
+		t.Errorf("got power load %v, expected 12345", v)
+	}
+
+	if v := value(t, samples, "kasa_online"); v != 1 {
+		t.Errorf("got online %v, expected 1", v)
+	}
+
+	if v := value(t, samples, "kasa_rssi"); v != -50 {
+		t.Errorf("got rssi %v, expected -50", v)
+	}
+
+	expected := map[string]string{
+		"id":    devicetest.DefaultDeviceInfo["device_id"].(string),
+		"alias": "Fake Plug",
+		"model": "P110",
+		"type":  "SMART.TAPOPLUG",
+	}
+
+	labels := samples["kasa_power_load"][0].labels
+
+	for name, v := range expected {
+		if labels[name] != v {
+			t.Errorf("got label %s=%q, expected %q", name, labels[name], v)
+		}
+	}
+
+	if _, ok := samples["kasa_errors_total"]; ok {
+		t.Errorf("got errors for a healthy device: %v", samples["kasa_errors_total"])
+	}
+}
+
+func TestPlugExporterDeviceOff(t *testing.T) {
+	exporter, fake := newExporter(t)
+
+	fake.Handle("get_device_info", devicetest.Result(map[string]interface{}{
+		"device_on": false,
+		"rssi":      -70,
+	}))
+
+	samples := scrape(t, exporter)
+
+	if v := value(t, samples, "kasa_online"); v != 0 {
+		t.Errorf("got online %v, expected 0", v)
+	}
+
+	if v := value(t, samples, "kasa_rssi"); v != -70 {
+		t.Errorf("got rssi %v, expected -70", v)
+	}
+}
+
+func TestPlugExporterErrors(t *testing.T) {
+	exporter, fake := newExporter(t)
+
+	fake.InjectFault(devicetest.Fault{Method: "get_energy_usage", ErrorCode: protocol.ErrorCodeCommonFailed})
+
+	for i := 0; i < 2; i++ {
+		samples := scrape(t, exporter)
+
+		if _, ok := samples["kasa_power_load"]; ok {
+			t.Errorf("got power load despite the error")
+		}
+
+		// the other metrics of the batch are still exported
+		if v := value(t, samples, "kasa_online"); v != 1 {
+			t.Errorf("got online %v, expected 1", v)
+		}
+
+		errors := samples["kasa_errors_total"]
+
+		if len(errors) != 1 || errors[0].labels["class"] != "device" || errors[0].value != float64(i+1) {
+			t.Errorf("got errors %v, expected %d device errors", errors, i+1)
+		}
+	}
+}
+
+func TestPlugExporterCancelled(t *testing.T) {
+	exporter, fake := newExporter(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	samples := scrape(t, exporter.WithContext(ctx))
+
+	if _, ok := samples["kasa_power_load"]; ok {
+		t.Errorf("got power load from a cancelled scrape")
+	}
+
+	if errors, ok := samples["kasa_errors_total"]; ok {
+		t.Errorf("got errors %v, expected a cancelled scrape not to count", errors)
+	}
+
+	if calls := fake.Calls("multipleRequest"); calls != 0 {
+		t.Errorf("cancelled scrape sent %d requests", calls)
+	}
+}
+
+// TestPlugExporterTimeout expects scrapes running out of time to count
+// as transient errors, unlike cancelled ones.
+func TestPlugExporterTimeout(t *testing.T) {
+	exporter, _ := newExporter(t)
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+
+	errors := scrape(t, exporter.WithContext(ctx))["kasa_errors_total"]
+
+	if len(errors) != 1 || errors[0].labels["class"] != "transient" {
+		t.Errorf("got errors %v, expected a transient error", errors)
+	}
+}
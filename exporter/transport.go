@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	"strconv"
+
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	_ prometheus.Collector = (*TransportCollector)(nil)
+	_ model.Observer       = (*TransportCollector)(nil)
+)
+
+// TransportCollector observes the transports of all devices and exports
+// the health of the connections to them.
+type TransportCollector struct {
+	handshakesInProgress *prometheus.GaugeVec
+	handshakes           *prometheus.CounterVec
+	handshakeDuration    *prometheus.HistogramVec
+	logins               *prometheus.CounterVec
+	requests             *prometheus.CounterVec
+	requestErrorCodes    *prometheus.CounterVec
+	requestDuration      *prometheus.HistogramVec
+	requestBytes         *prometheus.CounterVec
+	responseBytes        *prometheus.CounterVec
+}
+
+func NewTransportCollector() *TransportCollector {
+	return &TransportCollector{
+		handshakesInProgress: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "kasa_transport_handshakes_in_progress",
+			Help: "Handshakes currently in progress",
+		}, []string{"target", "transport"}),
+
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kasa_transport_handshakes_total",
+			Help: "Handshakes by result, either success or the error class",
+		}, []string{"target", "transport", "result"}),
+
+		handshakeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kasa_transport_handshake_duration_seconds",
+			Help:    "Duration of handshakes",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"target", "transport"}),
+
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kasa_transport_logins_total",
+			Help: "Logins by login version, credentials and result",
+		}, []string{"target", "transport", "login_version", "default_credentials", "result"}),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kasa_transport_requests_total",
+			Help: "Requests by method and result, either success or the error class",
+		}, []string{"target", "transport", "method", "result"}),
+
+		requestErrorCodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kasa_transport_request_error_codes_total",
+			Help: "Error codes returned by the device for requests",
+		}, []string{"target", "transport", "method", "error_code"}),
+
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "kasa_transport_request_duration_seconds",
+			Help:    "Duration of requests",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"target", "transport", "method"}),
+
+		requestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kasa_transport_request_bytes_total",
+			Help: "Bytes sent to the device",
+		}, []string{"target", "transport"}),
+
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "kasa_transport_response_bytes_total",
+			Help: "Bytes received from the device",
+		}, []string{"target", "transport"}),
+	}
+}
+
+func (c *TransportCollector) HandshakeStarted(event model.HandshakeEvent) {
+	c.handshakesInProgress.WithLabelValues(event.Address, event.Transport).Inc()
+}
+
+func (c *TransportCollector) HandshakeFinished(event model.HandshakeEvent) {
+	c.handshakesInProgress.WithLabelValues(event.Address, event.Transport).Dec()
+	c.handshakes.WithLabelValues(event.Address, event.Transport, result(event.Err)).Inc()
+	c.handshakeDuration.WithLabelValues(event.Address, event.Transport).Observe(event.Duration.Seconds())
+}
+
+func (c *TransportCollector) LoginFinished(event model.LoginEvent) {
+	c.logins.WithLabelValues(event.Address, event.Transport, strconv.Itoa(event.LoginVersion), strconv.FormatBool(event.DefaultCredentials), result(event.Err)).Inc()
+}
+
+func (c *TransportCollector) RequestFinished(event model.RequestEvent) {
+	c.requests.WithLabelValues(event.Address, event.Transport, event.Method, result(event.Err)).Inc()
+	c.requestDuration.WithLabelValues(event.Address, event.Transport, event.Method).Observe(event.Duration.Seconds())
+	c.requestBytes.WithLabelValues(event.Address, event.Transport).Add(float64(event.RequestBytes))
+	c.responseBytes.WithLabelValues(event.Address, event.Transport).Add(float64(event.ResponseBytes))
+
+	if event.ErrorCode != 0 {
+		c.requestErrorCodes.WithLabelValues(event.Address, event.Transport, event.Method, strconv.Itoa(event.ErrorCode)).Inc()
+	}
+}
+
+func (c *TransportCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+func (c *TransportCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+func (c *TransportCollector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		c.handshakesInProgress,
+		c.handshakes,
+		c.handshakeDuration,
+		c.logins,
+		c.requests,
+		c.requestErrorCodes,
+		c.requestDuration,
+		c.requestBytes,
+		c.responseBytes,
+	}
+}
+
+func result(err error) string {
+	if err == nil {
+		return "success"
+	}
+
+	return protocol.Classify(err).String()
+}
@@ -0,0 +1,144 @@
+package exporter
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/dehydr8/kasa-go/device"
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// find returns the value of the sample with the given labels.
+func find(t *testing.T, samples map[string][]sample, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	for _, s := range samples[name] {
+		matches := true
+
+		for label, value := range labels {
+			if s.labels[label] != value {
+				matches = false
+			}
+		}
+
+		if matches {
+			return s.value
+		}
+	}
+
+	t.Errorf("no sample of %s with labels %v in %v", name, labels, samples[name])
+
+	return 0
+}
+
+func TestTransportCollectorEvents(t *testing.T) {
+	collector := NewTransportCollector()
+
+	const address = "192.168.1.2"
+
+	handshake := model.HandshakeEvent{Address: address, Transport: protocol.TransportAes}
+
+	collector.HandshakeStarted(handshake)
+	collector.HandshakeStarted(handshake)
+
+	if v := find(t, scrape(t, collector), "kasa_transport_handshakes_in_progress", nil); v != 2 {
+		t.Errorf("got %v handshakes in progress, expected 2", v)
+	}
+
+	handshake.Duration = 10 * time.Millisecond
+	collector.HandshakeFinished(handshake)
+
+	handshake.Err = &protocol.StatusError{Operation: "handshake", StatusCode: 403}
+	collector.HandshakeFinished(handshake)
+
+	collector.LoginFinished(model.LoginEvent{Address: address, Transport: protocol.TransportAes, LoginVersion: 2, DefaultCredentials: true})
+
+	request := model.RequestEvent{Address: address, Transport: protocol.TransportAes, Method: "get_device_info", RequestBytes: 100, ResponseBytes: 200}
+
+	// a request failing and succeeding when retried
+	request.Err = &protocol.StatusError{Operation: "securePassthrough", StatusCode: 500}
+	collector.RequestFinished(request)
+
+	request.Err = nil
+	request.ErrorCode = int(protocol.ErrorCodeInvalidParams)
+	collector.RequestFinished(request)
+
+	samples := scrape(t, collector)
+
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected float64
+	}{
+		{"kasa_transport_handshakes_in_progress", map[string]string{"target": address}, 0},
+		{"kasa_transport_handshakes_total", map[string]string{"result": "success"}, 1},
+		{"kasa_transport_handshakes_total", map[string]string{"result": "session"}, 1},
+		{"kasa_transport_handshake_duration_seconds", map[string]string{"transport": protocol.TransportAes}, 2},
+		{"kasa_transport_logins_total", map[string]string{"login_version": "2", "default_credentials": "true", "result": "success"}, 1},
+		{"kasa_transport_requests_total", map[string]string{"method": "get_device_info", "result": "transient"}, 1},
+		{"kasa_transport_requests_total", map[string]string{"method": "get_device_info", "result": "success"}, 1},
+		{"kasa_transport_request_error_codes_total", map[string]string{"error_code": strconv.Itoa(int(protocol.ErrorCodeInvalidParams))}, 1},
+		{"kasa_transport_request_duration_seconds", map[string]string{"method": "get_device_info"}, 2},
+		{"kasa_transport_request_bytes_total", map[string]string{"target": address}, 200},
+		{"kasa_transport_response_bytes_total", map[string]string{"target": address}, 400},
+	}
+
+	for _, tt := range tests {
+		if v := find(t, samples, tt.name, tt.labels); v != tt.expected {
+			t.Errorf("got %s%v %v, expected %v", tt.name, tt.labels, v, tt.expected)
+		}
+	}
+
+	if n := len(samples["kasa_transport_request_error_codes_total"]); n != 1 {
+		t.Errorf("got %d error codes, expected only the one returned", n)
+	}
+}
+
+// TestTransportCollectorDevice expects the events of a transport retrying
+// a failed request to be collected.
+func TestTransportCollectorDevice(t *testing.T) {
+	fake := devicetest.NewDevice(credentials)
+	t.Cleanup(fake.Close)
+
+	collector := NewTransportCollector()
+
+	config := fake.Config()
+	config.Observer = collector
+	config.Retry = &model.DefaultRetryPolicy
+
+	key, err := protocol.GenerateKey(1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev, err := device.NewDevice(key, config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake.InjectFault(devicetest.Fault{Method: "get_device_info", StatusCode: 500, Times: 1})
+
+	if _, err := dev.GetDeviceInfo(context.Background()); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	samples := scrape(t, collector)
+
+	labels := map[string]string{"target": config.Address, "transport": protocol.TransportAes}
+
+	if v := find(t, samples, "kasa_transport_handshakes_total", labels); v != 1 {
+		t.Errorf("got %v handshakes, expected 1", v)
+	}
+
+	for result, expected := range map[string]float64{"transient": 1, "success": 1} {
+		if v := find(t, samples, "kasa_transport_requests_total", map[string]string{"method": "get_device_info", "result": result}); v != expected {
+			t.Errorf("got %v %s requests, expected %v", v, result, expected)
+		}
+	}
+}
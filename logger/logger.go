@@ -9,11 +9,18 @@ import (
 )
 
 var (
-	GLOBAL_LOGGER log.Logger
+	// GLOBAL_LOGGER discards everything until SetupLogging is called, so
+	// library and test code can log without setting it up
+	GLOBAL_LOGGER log.Logger = log.NewNopLogger()
 )
 
 func SetupLogging(lvl string) {
-	GLOBAL_LOGGER = log.NewLogfmtLogger(os.Stderr)
+	output := log.NewLogfmtLogger(os.Stderr)
+
+	// secrets are masked unless SetUnredacted is called
+	GLOBAL_LOGGER = log.LoggerFunc(func(keyvals ...interface{}) error {
+		return output.Log(redactKeyvals(keyvals)...)
+	})
 	GLOBAL_LOGGER = level.NewFilter(GLOBAL_LOGGER, level.Allow(level.ParseDefault(lvl, level.InfoValue())))
 	GLOBAL_LOGGER = log.With(GLOBAL_LOGGER, "ts", log.TimestampFormat(
 		func() time.Time { return time.Now() },
@@ -0,0 +1,148 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const redacted = "<redacted>"
+
+var unredacted atomic.Bool
+
+// sensitiveKeys are the log keys and JSON fields whose values are masked:
+// credentials, tokens, cookies, and details identifying a device or its
+// network.
+var sensitiveKeys = map[string]bool{
+	"username":        true,
+	"password":        true,
+	"password2":       true,
+	"hashed_password": true,
+	"cloudusername":   true,
+	"cloudpassword":   true,
+	"email":           true,
+	"token":           true,
+	"key":             true,
+	"cookie":          true,
+	"cookies":         true,
+	"set-cookie":      true,
+	"ssid":            true,
+	"mac":             true,
+	"mic_mac":         true,
+	"ip":              true,
+	"latitude":        true,
+	"longitude":       true,
+	"latitude_i":      true,
+	"longitude_i":     true,
+}
+
+// tokens and session ids in URLs, cookies and error messages
+var sensitivePattern = regexp.MustCompile(`((?:token|stok|TP_SESSIONID)=)[^&;\s"]+`)
+
+// SetUnredacted logs secrets and device details as they are when enabled,
+// for debugging protocol issues.
+func SetUnredacted(enabled bool) {
+	unredacted.Store(enabled)
+}
+
+// redactKeyvals masks the values of sensitive keys, and the sensitive
+// parts of string values such as JSON payloads and URLs.
+func redactKeyvals(keyvals []interface{}) []interface{} {
+	if unredacted.Load() {
+		return keyvals
+	}
+
+	result := make([]interface{}, len(keyvals))
+
+	for i := 0; i < len(keyvals); i += 2 {
+		result[i] = keyvals[i]
+
+		if i+1 >= len(keyvals) {
+			break
+		}
+
+		if key, ok := keyvals[i].(string); ok && sensitiveKeys[strings.ToLower(key)] {
+			result[i+1] = redacted
+			continue
+		}
+
+		result[i+1] = redactValue(keyvals[i+1])
+	}
+
+	return result
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactString(v)
+	case []byte:
+		return redactString(string(v))
+	case error:
+		return redactString(v.Error())
+	default:
+		return value
+	}
+}
+
+func redactString(value string) string {
+	trimmed := strings.TrimSpace(value)
+
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		if redacted, ok := redactJSON(trimmed); ok {
+			return redacted
+		}
+	}
+
+	return sensitivePattern.ReplaceAllString(value, "${1}"+redacted)
+}
+
+func redactJSON(value string) (string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+
+	var data interface{}
+
+	if err := decoder.Decode(&data); err != nil || decoder.More() {
+		return "", false
+	}
+
+	var buffer bytes.Buffer
+
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(redactData(data)); err != nil {
+		return "", false
+	}
+
+	return strings.TrimSuffix(buffer.String(), "\n"), true
+}
+
+func redactData(data interface{}) interface{} {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sensitiveKeys[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redactData(value)
+			}
+		}
+
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactData(value)
+		}
+
+		return v
+	case string:
+		// payloads nested as strings, as in the cloud passthrough
+		return redactString(v)
+	default:
+		return data
+	}
+}
@@ -0,0 +1,99 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRedactKeyvals(t *testing.T) {
+	tests := []struct {
+		name     string
+		keyvals  []interface{}
+		expected []interface{}
+	}{
+		{
+			name:     "sensitive keys",
+			keyvals:  []interface{}{"password", "secret", "Token", "abc", "key", []byte("pem"), "msg", "hello"},
+			expected: []interface{}{"password", redacted, "Token", redacted, "key", redacted, "msg", "hello"},
+		},
+		{
+			name:     "odd keyvals",
+			keyvals:  []interface{}{"msg", "hello", "password"},
+			expected: []interface{}{"msg", "hello", "password"},
+		},
+		{
+			name: "nested json",
+			keyvals: []interface{}{
+				"request", `{"method":"login_device","params":{"password":"secret","username":"user@example.com"}}`,
+			},
+			expected: []interface{}{
+				"request", `{"method":"login_device","params":{"password":"<redacted>","username":"<redacted>"}}`,
+			},
+		},
+		{
+			name: "device details",
+			keyvals: []interface{}{
+				"response", []byte(`{"error_code":0,"result":{"mac":"AA-BB-CC-DD-EE-FF","model":"P100","ssid":"home","rssi":-50}}`),
+			},
+			expected: []interface{}{
+				"response", `{"error_code":0,"result":{"mac":"<redacted>","model":"P100","rssi":-50,"ssid":"<redacted>"}}`,
+			},
+		},
+		{
+			name: "cloud request data",
+			keyvals: []interface{}{
+				"request", `{"method":"passthrough","params":{"deviceId":"1","requestData":"{\"method\":\"get_device_info\",\"params\":{\"token\":\"abc\"}}"}}`,
+			},
+			expected: []interface{}{
+				"request", `{"method":"passthrough","params":{"deviceId":"1","requestData":"{\"method\":\"get_device_info\",\"params\":{\"token\":\"<redacted>\"}}"}}`,
+			},
+		},
+		{
+			name:     "url",
+			keyvals:  []interface{}{"url", "https://eu-wap.tplinkcloud.com/?token=abc-123&appName=Kasa"},
+			expected: []interface{}{"url", "https://eu-wap.tplinkcloud.com/?token=<redacted>&appName=Kasa"},
+		},
+		{
+			name:     "error",
+			keyvals:  []interface{}{"err", errors.New(`Post "http://192.168.1.2/app?token=abc": connection refused`)},
+			expected: []interface{}{"err", `Post "http://192.168.1.2/app?token=<redacted>": connection refused`},
+		},
+		{
+			name:     "cookie",
+			keyvals:  []interface{}{"header", "TP_SESSIONID=abc;TIMEOUT=86400"},
+			expected: []interface{}{"header", "TP_SESSIONID=<redacted>;TIMEOUT=86400"},
+		},
+		{
+			name:     "invalid json",
+			keyvals:  []interface{}{"body", `{"password":"secret", token=abc`},
+			expected: []interface{}{"body", `{"password":"secret", token=<redacted>`},
+		},
+		{
+			name:     "other values",
+			keyvals:  []interface{}{"attempt", 2, "ok", true},
+			expected: []interface{}{"attempt", 2, "ok", true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactKeyvals(tt.keyvals)
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("got %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestUnredacted(t *testing.T) {
+	SetUnredacted(true)
+	defer SetUnredacted(false)
+
+	keyvals := []interface{}{"password", "secret", "url", "http://192.168.1.2/app?token=abc"}
+
+	if got := redactKeyvals(keyvals); fmt.Sprint(got) != fmt.Sprint(keyvals) {
+		t.Errorf("got %v, expected %v unredacted", got, keyvals)
+	}
+}
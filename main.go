@@ -1,16 +1,26 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/rsa"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/dehydr8/kasa-go/device"
+	"github.com/dehydr8/kasa-go/discovery"
 	"github.com/dehydr8/kasa-go/exporter"
 	"github.com/dehydr8/kasa-go/logger"
 	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
 	"github.com/dehydr8/kasa-go/util"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
@@ -23,12 +33,23 @@ import (
 
 type MetricsServer struct {
 	key           *rsa.PrivateKey
-	credentials   *model.Credentials
-	registryCache *lru.Cache[string, *prometheus.Registry]
+	config        *model.DeviceConfig
+	negotiator    *protocol.Negotiator
+	discoverer    *discovery.Discoverer
+	exporterCache *lru.Cache[string, *exporter.PlugExporter]
+	scrapeTimeout time.Duration
+
+	// records the device traffic when set
+	trace io.Writer
+
+	// requests waiting per device
+	queueLength int
 }
 
-func NewMetricsServer(key *rsa.PrivateKey, credentials *model.Credentials, cacheMax int) *MetricsServer {
-	cache, err := lru.New[string, *prometheus.Registry](cacheMax)
+// NewMetricsServer creates the server, config is the template for the
+// configuration of every scraped device.
+func NewMetricsServer(key *rsa.PrivateKey, config *model.DeviceConfig, discoverer *discovery.Discoverer, cacheMax int, scrapeTimeout time.Duration) *MetricsServer {
+	cache, err := lru.New[string, *exporter.PlugExporter](cacheMax)
 
 	if err != nil {
 		panic(err)
@@ -36,13 +57,16 @@ func NewMetricsServer(key *rsa.PrivateKey, credentials *model.Credentials, cache
 
 	return &MetricsServer{
 		key:           key,
-		credentials:   credentials,
-		registryCache: cache,
+		config:        config,
+		negotiator:    protocol.NewNegotiator(key),
+		discoverer:    discoverer,
+		exporterCache: cache,
+		scrapeTimeout: scrapeTimeout,
 	}
 }
 
-func (s *MetricsServer) getOrCreate(key string, create func() (*prometheus.Registry, error)) (*prometheus.Registry, error) {
-	if value, ok := s.registryCache.Get(key); ok {
+func (s *MetricsServer) getOrCreate(key string, create func() (*exporter.PlugExporter, error)) (*exporter.PlugExporter, error) {
+	if value, ok := s.exporterCache.Get(key); ok {
 		return value, nil
 	}
 
@@ -52,7 +76,7 @@ func (s *MetricsServer) getOrCreate(key string, create func() (*prometheus.Regis
 		return nil, err
 	}
 
-	s.registryCache.Add(key, value)
+	s.exporterCache.Add(key, value)
 
 	return value, nil
 }
@@ -62,12 +86,37 @@ func main() {
 
 	var (
 		lvl            = fs.StringEnum('l', "log", "log level: debug, info, warn, error", "info", "debug", "warn", "error")
+		logUnredacted  = fs.BoolLong("log_unredacted", "log credentials, tokens and device details unmasked, for debugging protocol issues")
 		address        = fs.String('a', "address", "", "address to listen on")
 		port           = fs.Int('p', "port", 9500, "port to listen on")
 		username       = fs.StringLong("username", "", "username for kasa login")
 		password       = fs.StringLong("password", "", "password for kasa login")
 		hashedPassword = fs.StringLong("hashed_password", "", "hashed (sha1) password for kasa login")
+		loginVersion   = fs.IntLong("login_version", 2, "AES login version tried first: 1, 2")
+		tryDefaults    = fs.BoolLong("try_default_credentials", "also try the default TP-Link credentials if the login is rejected")
 		maxRegistries  = fs.IntLong("max_registries", 16, "maximum number of registries to cache")
+		discoveryAddr  = fs.StringLong("discovery_target", discovery.DefaultTarget, "broadcast address for device discovery")
+		discoveryTime  = fs.DurationLong("discovery_timeout", discovery.DefaultTimeout, "how long to wait for discovery replies")
+		scrapeTimeout  = fs.DurationLong("scrape_timeout", 10*time.Second, "timeout for scrapes that don't specify one")
+		retryAttempts  = fs.IntLong("retry_attempts", model.DefaultRetryPolicy.MaxAttempts, "attempts per device request, 1 disables retries")
+		retryBackoff   = fs.DurationLong("retry_backoff", model.DefaultRetryPolicy.Backoff, "initial backoff between retries")
+		retryMaxBack   = fs.DurationLong("retry_max_backoff", model.DefaultRetryPolicy.MaxBackoff, "maximum backoff between retries")
+		retryRehand    = fs.StringLong("retry_rehandshake", strings.Join(model.DefaultRetryPolicy.Rehandshake, ","), "error classes retried on a new session")
+		retryOn        = fs.StringLong("retry_on", strings.Join(model.DefaultRetryPolicy.Retry, ","), "error classes retried with backoff")
+		httpConnect    = fs.DurationLong("http_connect_timeout", 0, "timeout for connecting to devices, 0 for the default")
+		httpResponse   = fs.DurationLong("http_response_timeout", 0, "timeout for the response headers of devices, 0 for none")
+		httpIdle       = fs.DurationLong("http_idle_timeout", 0, "how long idle device connections are kept, 0 for the default")
+		httpMaxIdle    = fs.IntLong("http_max_idle_conns", 0, "idle connections kept per device, 0 for the default")
+		httpKeepAlive  = fs.DurationLong("http_keepalive", 0, "TCP keep-alive period, 0 for the default, negative to disable")
+		httpNoReuse    = fs.BoolLong("http_disable_keepalives", "use a new connection for every device request")
+		httpSource     = fs.StringLong("http_source_address", "", "local IP or interface name to connect to devices from")
+		httpProxy      = fs.StringLong("http_proxy", "", "HTTP or SOCKS5 proxy URL to reach devices through, e.g. socks5://host:1080")
+		stateFile      = fs.StringLong("state_file", "", "file to persist the RSA key and device sessions across restarts")
+		traceFile      = fs.StringLong("trace_file", "", "file to append the decrypted device traffic to, for debugging")
+		keyFile        = fs.StringLong("key_file", "", "PEM file with the RSA key, generated on first run if missing")
+		keySize        = fs.IntLong("key_size", 1024, "size of generated RSA keys: 1024, 2048")
+		queueLength    = fs.IntLong("queue_length", protocol.DefaultQueueLength, "requests waiting per device before new ones are rejected")
+		cloudURL       = fs.StringLong("cloud_url", protocol.DefaultCloudURL, "TP-Link cloud URL for targets scraped with transport=cloud")
 	)
 
 	if err := ff.Parse(fs, os.Args[1:],
@@ -92,29 +141,191 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *loginVersion != 1 && *loginVersion != 2 {
+		fmt.Printf("%s\n", ffhelp.Flags(fs))
+		fmt.Printf("err=%v\n", "login_version must be 1 or 2")
+		os.Exit(1)
+	}
+
+	retry := &model.RetryPolicy{
+		MaxAttempts: *retryAttempts,
+		Backoff:     *retryBackoff,
+		MaxBackoff:  *retryMaxBack,
+		Rehandshake: splitList(*retryRehand),
+		Retry:       splitList(*retryOn),
+	}
+
+	for _, name := range append(append([]string{}, retry.Rehandshake...), retry.Retry...) {
+		if _, err := protocol.ParseErrorClass(name); err != nil {
+			fmt.Printf("%s\n", ffhelp.Flags(fs))
+			fmt.Printf("err=%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	httpOptions := &model.HTTPOptions{
+		ConnectTimeout:    *httpConnect,
+		ResponseTimeout:   *httpResponse,
+		IdleTimeout:       *httpIdle,
+		MaxIdleConns:      *httpMaxIdle,
+		KeepAlive:         *httpKeepAlive,
+		DisableKeepAlives: *httpNoReuse,
+		SourceAddress:     *httpSource,
+		Proxy:             *httpProxy,
+	}
+
+	if _, err := protocol.NewHTTPClient(httpOptions); err != nil {
+		fmt.Printf("%s\n", ffhelp.Flags(fs))
+		fmt.Printf("err=%v\n", err)
+		os.Exit(1)
+	}
+
 	logger.SetupLogging(*lvl)
 
-	credentials := model.Credentials{
-		Username:       *username,
-		Password:       *password,
-		HashedPassword: *hashedPassword,
+	if *logUnredacted {
+		logger.SetUnredacted(true)
+		logger.Warn("msg", "Logging unredacted, the log contains credentials and tokens")
 	}
 
-	logger.Debug("msg", "Generating RSA key")
+	if *httpProxy != "" && !strings.HasPrefix(*httpProxy, "socks5://") {
+		logger.Warn("msg", "Legacy devices can't be reached through an HTTP proxy, use a socks5 proxy for them")
+	}
 
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	config := model.DeviceConfig{
+		Credentials: &model.Credentials{
+			Username:       *username,
+			Password:       *password,
+			HashedPassword: *hashedPassword,
+		},
+		LoginVersion:          *loginVersion,
+		TryDefaultCredentials: *tryDefaults,
+		HTTP:                  httpOptions,
+		Retry:                 retry,
+		CloudURL:              *cloudURL,
+	}
 
-	if err != nil {
-		panic(err)
+	transportCollector := exporter.NewTransportCollector()
+	prometheus.MustRegister(transportCollector)
+
+	config.Observer = protocol.MultiObserver(transportCollector, &protocol.LoggingObserver{})
+
+	var (
+		key   *rsa.PrivateKey
+		store *protocol.FileSessionStore
+		err   error
+	)
+
+	if *keyFile != "" {
+		if key, err = protocol.LoadOrGenerateKey(*keyFile, *keySize); err != nil {
+			logger.Error("msg", "Error loading RSA key", "path", *keyFile, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *stateFile != "" {
+		store, err = protocol.NewFileSessionStore(*stateFile)
+
+		if err != nil {
+			logger.Error("msg", "Error loading state file", "path", *stateFile, "err", err)
+			os.Exit(1)
+		}
+
+		if key == nil {
+			if key, err = store.Key(); err != nil {
+				logger.Error("msg", "Error loading RSA key from state file", "path", *stateFile, "err", err)
+				os.Exit(1)
+			}
+		}
+
+		config.Sessions = store
+		config.Pins = store
+	}
+
+	if key == nil {
+		logger.Debug("msg", "Generating RSA key", "bits", *keySize)
+
+		if key, err = protocol.GenerateKey(*keySize); err != nil {
+			logger.Error("msg", "Error generating RSA key", "err", err)
+			os.Exit(1)
+		}
 	}
 
-	server := NewMetricsServer(key, &credentials, *maxRegistries)
+	if store != nil {
+		// drops the stored sessions if the key changed
+		if err := store.SetKey(key); err != nil {
+			logger.Error("msg", "Error saving RSA key to state file", "path", *stateFile, "err", err)
+			os.Exit(1)
+		}
+	}
+
+	discoverer := discovery.NewDiscoverer(key)
+	discoverer.Target = *discoveryAddr
+	discoverer.Timeout = *discoveryTime
+
+	server := NewMetricsServer(key, &config, discoverer, *maxRegistries, *scrapeTimeout)
+	server.queueLength = *queueLength
+
+	if *traceFile != "" {
+		trace, err := os.OpenFile(*traceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+		if err != nil {
+			logger.Error("msg", "Error opening trace file", "path", *traceFile, "err", err)
+			os.Exit(1)
+		}
+
+		defer trace.Close()
+
+		logger.Warn("msg", "Recording device traffic, the trace contains device details", "path", *traceFile)
+
+		server.trace = trace
+	}
 
 	http.HandleFunc("/scrape", server.ScrapeHandler)
+	http.HandleFunc("/discover", server.DiscoverHandler)
+	http.Handle("/metrics", promhttp.Handler())
+
+	// cancelled on shutdown, which aborts in-flight device requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := &http.Server{
+		Addr: fmt.Sprintf("%s:%d", *address, *port),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
 
-	logger.Info("msg", "Starting metrics server", "address", fmt.Sprintf("%s:%d", *address, *port))
+	go func() {
+		<-ctx.Done()
 
-	http.ListenAndServe(fmt.Sprintf("%s:%d", *address, *port), nil)
+		logger.Info("msg", "Shutting down metrics server")
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("msg", "Starting metrics server", "address", httpServer.Addr)
+
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Error("msg", "Error running metrics server", "err", err)
+		os.Exit(1)
+	}
+}
+
+// scrapeContext bounds the scrape by the timeout Prometheus announces,
+// falling back to the configured one.
+func (s *MetricsServer) scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout := s.scrapeTimeout
+
+	if header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+	}
+
+	return context.WithTimeout(r.Context(), timeout)
 }
 
 func (s *MetricsServer) ScrapeHandler(w http.ResponseWriter, r *http.Request) {
@@ -124,36 +335,132 @@ func (s *MetricsServer) ScrapeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	registry, err := s.getOrCreate(target, func() (*prometheus.Registry, error) {
+	transport := r.URL.Query().Get("transport")
+	switch transport {
+	case "":
+		transport = "auto"
+	case "auto", protocol.TransportAes, protocol.TransportKlap, protocol.TransportLegacy, protocol.TransportCloud, protocol.TransportTls:
+	default:
+		http.Error(w, fmt.Sprintf("unknown transport '%s'", transport), 400)
+		return
+	}
 
-		logger.Debug("msg", "Creating new registry for target", "target", target)
+	var parsed *model.Target
 
-		device, err := device.NewDevice(s.key, &model.DeviceConfig{
-			Address:     target,
-			Credentials: s.credentials,
-		})
+	// cloud targets are device ids
+	if transport != protocol.TransportCloud {
+		var err error
 
-		if err != nil {
-			return nil, err
+		if parsed, err = model.ParseTarget(target); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
 		}
+	}
 
-		exporter, err := exporter.NewPlugExporter(device)
+	ctx, cancel := s.scrapeContext(r)
+	defer cancel()
 
-		if err != nil {
-			return nil, err
+	plugExporter, err := s.getOrCreate(transport+"://"+target, func() (*exporter.PlugExporter, error) {
+
+		logger.Debug("msg", "Creating new exporter for target", "target", target, "transport", transport)
+
+		config := *s.config
+		config.Address = target
+		config.Target = parsed
+
+		var proto protocol.Protocol
+
+		if transport == "auto" {
+			proto = s.negotiator.Transport(&config)
+		} else {
+			var err error
+
+			if proto, err = protocol.NewTransport(transport, s.key, &config); err != nil {
+				return nil, err
+			}
 		}
 
-		registry := prometheus.NewRegistry()
-		registry.MustRegister(exporter)
+		if s.trace != nil {
+			proto = protocol.NewRecordingTransport(proto, s.trace)
+		}
+
+		proto = protocol.NewScheduler(proto, s.queueLength)
 
-		return registry, nil
+		return exporter.NewPlugExporter(ctx, device.NewDeviceWithTransport(&config, proto))
 	})
 
 	if err != nil {
-		logger.Error("msg", "Error creating registry", "err", err)
-		http.Error(w, err.Error(), 500)
+		class := protocol.Classify(err)
+		logger.Error("msg", "Error creating exporter", "target", target, "class", class, "err", err)
+		http.Error(w, err.Error(), statusForError(class))
 		return
 	}
 
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(plugExporter.WithContext(ctx))
+
 	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
 }
+
+func splitList(value string) []string {
+	var list []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+func statusForError(class protocol.ErrorClass) int {
+	switch class {
+	case protocol.ErrorClassAuthentication:
+		return http.StatusForbidden
+	case protocol.ErrorClassTransient:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+type discoveryTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// DiscoverHandler serves the discovered devices in the format expected
+// by Prometheus' http_sd_configs.
+func (s *MetricsServer) DiscoverHandler(w http.ResponseWriter, r *http.Request) {
+	results, err := s.discoverer.DiscoverContext(r.Context())
+
+	if err != nil && r.Context().Err() != nil {
+		logger.Debug("msg", "discovery cancelled", "err", err)
+		return
+	}
+
+	if err != nil {
+		logger.Error("msg", "Error discovering devices", "err", err)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	groups := make([]discoveryTargetGroup, 0, len(results))
+
+	for _, result := range results {
+		groups = append(groups, discoveryTargetGroup{
+			Targets: []string{result.IP},
+			Labels: map[string]string{
+				"__meta_kasa_device_id": result.DeviceId,
+				"__meta_kasa_model":     result.Model,
+				"__meta_kasa_type":      result.DeviceType,
+				"__meta_kasa_mac":       result.MAC,
+				"__meta_kasa_transport": result.Transport(),
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
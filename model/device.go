@@ -8,10 +8,48 @@ type Credentials struct {
 	HashedPassword string
 }
 
+// DefaultCredentials are the well-known credentials accepted by devices
+// that were factory reset or never bound to a cloud account.
+var DefaultCredentials = []Credentials{
+	{Username: "test@tp-link.net", Password: "test"},
+	{Username: "kasa@tp-link.net", Password: "kasaSetup"},
+}
+
 type DeviceConfig struct {
 	Address string
 
+	// Target is where the device is reached, parsed from Address if nil
+	Target *Target
+
 	Credentials *Credentials
 
+	// LoginVersion is the AES login version tried first, 1 or 2 (default)
+	LoginVersion int
+
+	// TryDefaultCredentials also tries DefaultCredentials when the
+	// credentials are rejected
+	TryDefaultCredentials bool
+
+	// Key is the RSA key for the AES handshake, overriding the shared key
 	Key *rsa.PrivateKey
+
+	// HTTP configures the HTTP client of the transports, defaults if nil
+	HTTP *HTTPOptions
+
+	// Retry is the retry policy for requests, nil disables retries
+	Retry *RetryPolicy
+
+	// Sessions persists sessions across restarts when set
+	Sessions SessionStore
+
+	// Pins persists the certificate pins of the TLS transport when set,
+	// otherwise they are kept for the lifetime of the transport
+	Pins PinStore
+
+	// Observer receives the transport events when set
+	Observer Observer
+
+	// CloudURL is the URL of the TP-Link cloud for the cloud transport,
+	// the default cloud if empty
+	CloudURL string
 }
@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+// HTTPOptions configures the HTTP client of a transport, zero values keep
+// the defaults of net/http.
+type HTTPOptions struct {
+	// ConnectTimeout bounds establishing the connection
+	ConnectTimeout time.Duration
+
+	// ResponseTimeout bounds waiting for the response headers
+	ResponseTimeout time.Duration
+
+	// IdleTimeout closes connections idle for longer
+	IdleTimeout time.Duration
+
+	// MaxIdleConns limits the idle connections kept per device
+	MaxIdleConns int
+
+	// KeepAlive is the TCP keep-alive period, negative to disable it
+	KeepAlive time.Duration
+
+	// DisableKeepAlives opens a new connection for every request
+	DisableKeepAlives bool
+
+	// SourceAddress is the local IP or interface name to connect from
+	SourceAddress string
+
+	// Proxy is the URL of an HTTP, HTTPS or SOCKS5 proxy
+	Proxy string
+}
@@ -0,0 +1,46 @@
+package model
+
+import "time"
+
+// Observer receives events from a transport, it is called synchronously
+// and must be safe for concurrent use.
+type Observer interface {
+	HandshakeStarted(event HandshakeEvent)
+	HandshakeFinished(event HandshakeEvent)
+	LoginFinished(event LoginEvent)
+	RequestFinished(event RequestEvent)
+}
+
+type HandshakeEvent struct {
+	Address   string
+	Transport string
+
+	// Duration and Err are only set once the handshake finished
+	Duration time.Duration
+	Err      error
+}
+
+type LoginEvent struct {
+	Address   string
+	Transport string
+
+	LoginVersion       int
+	DefaultCredentials bool
+
+	Duration time.Duration
+	Err      error
+}
+
+type RequestEvent struct {
+	Address   string
+	Transport string
+	Method    string
+
+	Duration      time.Duration
+	RequestBytes  int
+	ResponseBytes int
+
+	// ErrorCode is the error code returned by the device, if any
+	ErrorCode int
+	Err       error
+}
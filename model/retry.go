@@ -0,0 +1,29 @@
+package model
+
+import "time"
+
+// RetryPolicy controls how a transport retries failed requests. Error
+// classes are referred to by name, e.g. "session" or "transient".
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, it doubles with every
+	// further retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Rehandshake lists the error classes retried right away on a new
+	// session, Retry those retried with backoff on the current session.
+	// Errors of any other class are returned immediately.
+	Rehandshake []string
+	Retry       []string
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     250 * time.Millisecond,
+	MaxBackoff:  2 * time.Second,
+	Rehandshake: []string{"session"},
+	Retry:       []string{"transient"},
+}
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// SessionState is what a transport needs to resume a session with a
+// device without a new handshake and login.
+type SessionState struct {
+	// Key holds the session key followed by the IV
+	Key     []byte            `json:"key"`
+	Cookies map[string]string `json:"cookies"`
+	Token   string            `json:"token"`
+	Expiry  time.Time         `json:"expiry"`
+}
+
+// SessionStore keeps session state per device address.
+type SessionStore interface {
+	Load(address string) (*SessionState, bool)
+	Save(address string, state *SessionState) error
+	Delete(address string) error
+}
+
+// PinStore keeps the certificate fingerprint pinned per device address,
+// trusted on first use.
+type PinStore interface {
+	Pin(address string) (string, bool)
+	SetPin(address, fingerprint string) error
+}
@@ -0,0 +1,151 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Target is where a device is reached: a host with an optional scheme,
+// port and path.
+type Target struct {
+	// Scheme is http or https, http if empty
+	Scheme string
+
+	// Host is a hostname or an IP address, without brackets
+	Host string
+
+	// Port is the port of the device, the default of the transport if 0
+	Port int
+
+	// Path replaces the base path of the HTTP transports, "/app", if set
+	Path string
+}
+
+// ParseTarget parses a target given as a host, host:port, a bare or
+// bracketed IPv6 address, or a URL such as https://host:8443/app.
+func ParseTarget(target string) (*Target, error) {
+	target = strings.TrimSpace(target)
+
+	if target == "" {
+		return nil, fmt.Errorf("empty target")
+	}
+
+	// IPv6 addresses are only bracketed when they come with a port
+	if addr, err := netip.ParseAddr(target); err == nil {
+		return &Target{Host: addr.String()}, nil
+	}
+
+	raw := escapeZone(target)
+
+	if !strings.Contains(target, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %q: %w", target, err)
+	}
+
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid target %q: unexpected credentials, query or fragment", target)
+	}
+
+	t := &Target{
+		Host: u.Hostname(),
+		Path: strings.TrimSuffix(u.Path, "/"),
+	}
+
+	if strings.Contains(target, "://") {
+		switch u.Scheme {
+		case "http", "https":
+			t.Scheme = u.Scheme
+		default:
+			return nil, fmt.Errorf("invalid target %q: unsupported scheme %q", target, u.Scheme)
+		}
+	}
+
+	if t.Host == "" {
+		return nil, fmt.Errorf("invalid target %q: missing host", target)
+	}
+
+	if port := u.Port(); port != "" {
+		if t.Port, err = strconv.Atoi(port); err != nil || t.Port < 1 || t.Port > 65535 {
+			return nil, fmt.Errorf("invalid target %q: invalid port %q", target, port)
+		}
+	}
+
+	return t, nil
+}
+
+// escapeZone escapes the zone of a bracketed IPv6 host, such as
+// [fe80::1%eth0]:80, which url.Parse only accepts as %25.
+func escapeZone(target string) string {
+	start := strings.Index(target, "[")
+	end := strings.Index(target, "]")
+
+	if start < 0 || end < start {
+		return target
+	}
+
+	host := target[start+1 : end]
+	zone := strings.Index(host, "%")
+
+	if zone < 0 || strings.HasPrefix(host[zone:], "%25") {
+		return target
+	}
+
+	return target[:start+1] + host[:zone] + "%25" + host[zone+1:] + target[end:]
+}
+
+// HostPort returns the host and port to connect to, with the given port
+// if the target has none.
+func (t *Target) HostPort(defaultPort int) string {
+	port := t.Port
+
+	if port == 0 {
+		port = defaultPort
+	}
+
+	return net.JoinHostPort(t.Host, strconv.Itoa(port))
+}
+
+// URL returns the URL of the path below the base path of the target,
+// defaultBase if the target has no path.
+func (t *Target) URL(defaultBase, path string) string {
+	scheme := t.Scheme
+
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	host := t.Host
+
+	if t.Port != 0 {
+		host = net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	base := t.Path
+
+	if base == "" {
+		base = defaultBase
+	}
+
+	u := url.URL{
+		Scheme: scheme,
+		Host:   host,
+		Path:   base + path,
+	}
+
+	return u.String()
+}
+
+func (t *Target) String() string {
+	return t.URL("", "")
+}
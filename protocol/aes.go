@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rsa"
@@ -12,7 +13,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dehydr8/kasa-go/logger"
@@ -22,8 +23,12 @@ import (
 var _ Protocol = (*AesTransport)(nil)
 
 type AesTransport struct {
-	config       *model.DeviceConfig
-	loginVersion int
+	config *model.DeviceConfig
+	url    string
+
+	// the login that succeeded last, tried first on the next login
+	loginVersion     int
+	loginCredentials *model.Credentials
 
 	key     *rsa.PrivateKey
 	session *AesEncryptedSession
@@ -37,7 +42,8 @@ type AesTransport struct {
 
 	commonHeaders map[string]string
 
-	sendLock sync.Mutex
+	closed   atomic.Bool
+	sendLock sendLock
 }
 
 type AesProtoBaseRequest struct {
@@ -99,15 +105,41 @@ type AesPassthroughResponse struct {
 	Result AesPassthroughResponseResult `json:"result"`
 }
 
+// NewAesTransport creates the transport, the key of the config takes
+// precedence over the given one.
 func NewAesTransport(key *rsa.PrivateKey, config *model.DeviceConfig) (*AesTransport, error) {
-	return &AesTransport{
+	if config.Key != nil {
+		key = config.Key
+	}
+
+	loginVersion := config.LoginVersion
+
+	if loginVersion != 1 {
+		loginVersion = 2
+	}
+
+	target, err := targetOf(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := NewHTTPClient(config.HTTP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &AesTransport{
 		key:    key,
 		config: config,
+		url:    target.URL("/app", ""),
 
-		loginVersion:  2,
-		handshakeDone: false,
+		loginVersion:     loginVersion,
+		loginCredentials: config.Credentials,
+		handshakeDone:    false,
 
-		httpClient: &http.Client{},
+		httpClient: httpClient,
 		commonHeaders: map[string]string{
 			"Content-Type": "application/json",
 			"Accept":       "application/json",
@@ -115,15 +147,36 @@ func NewAesTransport(key *rsa.PrivateKey, config *model.DeviceConfig) (*AesTrans
 		},
 		cookies:       make(map[string]string),
 		sessionExpiry: time.Now(),
-	}, nil
+		sendLock:      newSendLock(),
+	}
+
+	t.restoreSession()
+
+	return t, nil
 }
 
 func (t *AesTransport) Send(request, response interface{}) error {
-	t.sendLock.Lock()
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *AesTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if err := t.sendLock.Lock(ctx); err != nil {
+		return err
+	}
 	defer t.sendLock.Unlock()
 
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	return withRetry(ctx, t.config.Retry, t.config.Address, t.resetSession, func() error {
+		return t.send(ctx, request, response)
+	})
+}
+
+func (t *AesTransport) send(ctx context.Context, request, response interface{}) error {
 	if !t.handshakeDone || t.handshakeExpired() {
-		err := t.handshake()
+		err := t.handshake(ctx)
 
 		if err != nil {
 			return err
@@ -131,33 +184,51 @@ func (t *AesTransport) Send(request, response interface{}) error {
 	}
 
 	if t.loginToken == "" {
-		err := t.login()
+		err := t.login(ctx)
 
 		if err != nil {
 			return err
 		}
 	}
 
-	err := t.securePassthrough(request, response)
+	err := t.securePassthrough(ctx, request, response)
 
-	if err != nil {
-		// assume session expired
-		// TODO: handle error codes
-		t.loginToken = ""
-		t.session = nil
-		t.sessionExpiry = time.Now()
-		t.handshakeDone = false
-		return err
+	// only a session error says the session is gone, whether other errors
+	// need a new session is up to the retry policy
+	if err != nil && ctx.Err() == nil && Classify(err) == ErrorClassSession {
+		t.resetSession()
 	}
 
-	return nil
+	return err
+}
+
+func (t *AesTransport) resetSession() {
+	t.loginToken = ""
+	t.session = nil
+	t.sessionExpiry = time.Now()
+	t.handshakeDone = false
+
+	if t.config.Sessions != nil {
+		if err := t.config.Sessions.Delete(t.config.Address); err != nil {
+			logger.Warn("msg", "unable to delete persisted session", "target", t.config.Address, "err", err)
+		}
+	}
 }
 
 func (t *AesTransport) Close() error {
+	t.closed.Store(true)
+	t.httpClient.CloseIdleConnections()
+
 	return nil
 }
 
-func (t *AesTransport) handshake() error {
+func (t *AesTransport) handshake(ctx context.Context) error {
+	return observeHandshake(t.config, TransportAes, func() error {
+		return t.performHandshake(ctx)
+	})
+}
+
+func (t *AesTransport) performHandshake(ctx context.Context) error {
 
 	logger.Debug("msg", "performing handshake", "target", t.config.Address)
 
@@ -188,7 +259,7 @@ func (t *AesTransport) handshake() error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/app", t.config.Address), bytes.NewBuffer(marshalled))
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewBuffer(marshalled))
 
 	if err != nil {
 		return err
@@ -205,12 +276,12 @@ func (t *AesTransport) handshake() error {
 		return err
 	}
 
+	defer res.Body.Close()
+
 	if res.StatusCode != 200 {
-		return fmt.Errorf("handshake failed with status code %d", res.StatusCode)
+		return &StatusError{Operation: "handshake", StatusCode: res.StatusCode}
 	}
 
-	defer res.Body.Close()
-
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return err
@@ -221,11 +292,13 @@ func (t *AesTransport) handshake() error {
 	err = json.Unmarshal(body, &response)
 
 	if err != nil {
-		return err
+		return &DecodeError{Operation: "handshake", Stage: DecodeStageJSON, Err: err}
 	}
 
+	// devices that only speak klap reject the handshake method with
+	// ErrorCodeProtocolNotSupported
 	if response.ErrorCode != 0 {
-		return fmt.Errorf("handshake failed with error code %d", response.ErrorCode)
+		return &DeviceError{Method: "handshake", Code: ErrorCode(response.ErrorCode)}
 	}
 
 	for _, c := range res.Cookies() {
@@ -248,28 +321,108 @@ func (t *AesTransport) handshakeExpired() bool {
 	return time.Now().After(t.sessionExpiry)
 }
 
-func (t *AesTransport) login() error {
+type aesLogin struct {
+	credentials *model.Credentials
+	version     int
+}
 
-	logger.Debug("msg", "performing login", "target", t.config.Address)
+// logins returns the logins to try, starting with the one that succeeded
+// last and falling back to the other login version and, if enabled, to the
+// default credentials.
+func (t *AesTransport) logins() []aesLogin {
+	credentials := []*model.Credentials{t.loginCredentials}
+
+	if t.loginCredentials != t.config.Credentials {
+		credentials = append(credentials, t.config.Credentials)
+	}
+
+	if t.config.TryDefaultCredentials {
+		for i := range model.DefaultCredentials {
+			if &model.DefaultCredentials[i] != t.loginCredentials {
+				credentials = append(credentials, &model.DefaultCredentials[i])
+			}
+		}
+	}
+
+	var logins []aesLogin
+
+	for _, creds := range credentials {
+		for _, version := range []int{t.loginVersion, 3 - t.loginVersion} {
+			// v1 sends the plain password
+			if version == 1 && creds.Password == "" {
+				continue
+			}
+
+			logins = append(logins, aesLogin{credentials: creds, version: version})
+		}
+	}
+
+	return logins
+}
+
+func (t *AesTransport) login(ctx context.Context) error {
+	var err error
+
+	for i, login := range t.logins() {
+		if i > 0 {
+			// the device may drop the session after a failed login
+			if err := t.handshake(ctx); err != nil {
+				return err
+			}
+		}
+
+		start := time.Now()
+
+		err = t.tryLogin(ctx, login)
+
+		observerFor(t.config).LoginFinished(model.LoginEvent{
+			Address:            t.config.Address,
+			Transport:          TransportAes,
+			LoginVersion:       login.version,
+			DefaultCredentials: login.credentials != t.config.Credentials,
+			Duration:           time.Since(start),
+			Err:                err,
+		})
+
+		if err == nil {
+			t.reportLogin(login)
+			t.saveSession()
+
+			return nil
+		}
+
+		if Classify(err) != ErrorClassAuthentication {
+			return err
+		}
+
+		logger.Debug("msg", "login rejected", "target", t.config.Address, "login_version", login.version, "username", login.credentials.Username, "err", err)
+	}
+
+	return err
+}
+
+func (t *AesTransport) tryLogin(ctx context.Context, login aesLogin) error {
+
+	logger.Debug("msg", "performing login", "target", t.config.Address, "login_version", login.version)
 
 	req := &AesLoginRequest{
 		AesProtoBaseRequest: AesProtoBaseRequest{
 			Method: "login_device",
 		},
-		Params:            t.loginParameters(),
+		Params:            loginParameters(login.credentials, login.version),
 		RequestTimeMillis: time.Now().UnixMilli(),
 	}
 
 	var res AesLoginResponse
 
-	err := t.securePassthrough(req, &res)
+	err := t.securePassthrough(ctx, req, &res)
 
 	if err != nil {
 		return err
 	}
 
 	if res.ErrorCode != 0 {
-		return fmt.Errorf("login failed with error code %d", res.ErrorCode)
+		return &DeviceError{Method: "login_device", Code: ErrorCode(res.ErrorCode)}
 	}
 
 	t.loginToken = res.Result.Token
@@ -277,28 +430,131 @@ func (t *AesTransport) login() error {
 	return nil
 }
 
-func (t *AesTransport) securePassthrough(request interface{}, response interface{}) error {
-	if t.session == nil {
-		return fmt.Errorf("session not initialized")
+// reportLogin logs logins that differ from the configured one, which
+// usually points to a device that is not provisioned as expected.
+func (t *AesTransport) reportLogin(login aesLogin) {
+	changed := login.version != t.loginVersion || login.credentials != t.loginCredentials
+
+	t.loginVersion = login.version
+	t.loginCredentials = login.credentials
+
+	if !changed {
+		return
 	}
 
-	url := fmt.Sprintf("http://%s/app", t.config.Address)
-	if t.loginToken != "" {
-		url = fmt.Sprintf("%s?token=%s", url, t.loginToken)
+	if login.credentials != t.config.Credentials {
+		logger.Warn("msg", "device accepted default credentials", "target", t.config.Address, "login_version", login.version, "username", login.credentials.Username)
+	} else {
+		logger.Info("msg", "logged in with fallback login version", "target", t.config.Address, "login_version", login.version)
 	}
+}
+
+// Login returns the login version and credentials of the last successful
+// login.
+func (t *AesTransport) Login() (int, *model.Credentials) {
+	return t.loginVersion, t.loginCredentials
+}
+
+// restoreSession resumes a persisted session, if it is still valid.
+func (t *AesTransport) restoreSession() {
+	if t.config.Sessions == nil {
+		return
+	}
+
+	state, ok := t.config.Sessions.Load(t.config.Address)
+
+	if !ok || state.Token == "" {
+		return
+	}
+
+	session, err := newAesEncryptedSessionFromKey(state.Key)
 
+	if err != nil {
+		logger.Warn("msg", "ignoring persisted session", "target", t.config.Address, "err", err)
+		return
+	}
+
+	logger.Debug("msg", "restored session", "target", t.config.Address, "expiry", state.Expiry)
+
+	t.session = session
+	t.sessionExpiry = state.Expiry
+	t.loginToken = state.Token
+	t.handshakeDone = true
+
+	for k, v := range state.Cookies {
+		t.cookies[k] = v
+	}
+}
+
+func (t *AesTransport) saveSession() {
+	if t.config.Sessions == nil {
+		return
+	}
+
+	cookies := make(map[string]string, len(t.cookies))
+
+	for k, v := range t.cookies {
+		cookies[k] = v
+	}
+
+	err := t.config.Sessions.Save(t.config.Address, &model.SessionState{
+		Key:     t.session.key,
+		Cookies: cookies,
+		Token:   t.loginToken,
+		Expiry:  t.sessionExpiry,
+	})
+
+	if err != nil {
+		logger.Warn("msg", "unable to persist session", "target", t.config.Address, "err", err)
+	}
+}
+
+func (t *AesTransport) securePassthrough(ctx context.Context, request interface{}, response interface{}) error {
 	marshalledRequest, err := json.Marshal(request)
 
 	if err != nil {
 		return err
 	}
 
+	event := &model.RequestEvent{
+		Address:   t.config.Address,
+		Transport: TransportAes,
+		Method:    requestMethod(marshalledRequest),
+	}
+
+	start := time.Now()
+
+	decrypted, err := t.passthrough(ctx, marshalledRequest, event)
+
+	if err == nil {
+		if err = json.Unmarshal(decrypted, response); err != nil {
+			err = &DecodeError{Operation: "securePassthrough", Stage: DecodeStageResult, Err: err}
+		}
+	}
+
+	finishRequest(t.config, event, start, decrypted, err)
+
+	return err
+}
+
+// passthrough sends the encrypted request and returns the decrypted
+// response.
+func (t *AesTransport) passthrough(ctx context.Context, marshalledRequest []byte, event *model.RequestEvent) ([]byte, error) {
+	if t.session == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+
+	url := t.url
+	if t.loginToken != "" {
+		url = fmt.Sprintf("%s?token=%s", url, t.loginToken)
+	}
+
 	logger.Debug("msg", "sending request", "request", string(marshalledRequest))
 
 	encrypted, err := t.session.Encrypt(marshalledRequest)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	marshalled, err := json.Marshal(&AesPassthroughRequest{
@@ -311,13 +567,15 @@ func (t *AesTransport) securePassthrough(request interface{}, response interface
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(marshalled))
+	event.RequestBytes = len(marshalled)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(marshalled))
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for k, v := range t.commonHeaders {
@@ -334,56 +592,68 @@ func (t *AesTransport) securePassthrough(request interface{}, response interface
 	httpRes, err := t.httpClient.Do(req)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	defer httpRes.Body.Close()
 
+	if httpRes.StatusCode != 200 {
+		return nil, &StatusError{Operation: "securePassthrough", StatusCode: httpRes.StatusCode}
+	}
+
 	body, err := io.ReadAll(httpRes.Body)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	event.ResponseBytes = len(body)
+
+	return decodePassthroughResponse(t.session, body)
+}
+
+// decodePassthroughResponse unwraps and decrypts the response of the
+// device from the securePassthrough envelope.
+func decodePassthroughResponse(session *AesEncryptedSession, body []byte) ([]byte, error) {
 	var res AesPassthroughResponse
 
-	err = json.Unmarshal(body, &res)
+	err := json.Unmarshal(body, &res)
 
 	if err != nil {
-		return err
+		return nil, &DecodeError{Operation: "securePassthrough", Stage: DecodeStageJSON, Err: err}
 	}
 
 	logger.Debug("msg", "received encrypted response", "encrypted", res.Result.Response)
 
 	if res.ErrorCode != 0 {
-		return fmt.Errorf("passthrough failed with error code %d", res.ErrorCode)
+		return nil, &DeviceError{Method: "securePassthrough", Code: ErrorCode(res.ErrorCode)}
 	}
 
 	decoded, err := base64.StdEncoding.DecodeString(res.Result.Response)
 
 	if err != nil {
-		return err
+		return nil, &DecodeError{Operation: "securePassthrough", Stage: DecodeStageBase64, Err: err}
 	}
 
-	decrypted, err := t.session.Decrypt(decoded)
+	decrypted, err := session.Decrypt(decoded)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	logger.Debug("msg", "decrypted response", "response", string(decrypted))
 
-	return json.Unmarshal(decrypted, response)
+	return decrypted, nil
 }
 
-func (t *AesTransport) loginParameters() map[string]string {
+func loginParameters(creds *model.Credentials, version int) map[string]string {
 	params := make(map[string]string)
 
-	user, pass := t.hashCredentials(t.loginVersion == 2)
+	user, pass := hashCredentials(creds, version == 2)
 
 	params["username"] = user
 
-	if t.loginVersion == 2 {
+	if version == 2 {
 		params["password2"] = pass
 	} else {
 		params["password"] = pass
@@ -392,19 +662,19 @@ func (t *AesTransport) loginParameters() map[string]string {
 	return params
 }
 
-func (t *AesTransport) hashCredentials(v2 bool) (string, string) {
-	user := base64.StdEncoding.EncodeToString([]byte(sha1Hash([]byte(t.config.Credentials.Username))))
+func hashCredentials(creds *model.Credentials, v2 bool) (string, string) {
+	user := base64.StdEncoding.EncodeToString([]byte(sha1Hash([]byte(creds.Username))))
 	var pass string
 
 	if v2 {
 		// if we already have the hashed password, use it
-		if t.config.Credentials.HashedPassword != "" {
-			pass = base64.StdEncoding.EncodeToString([]byte(t.config.Credentials.HashedPassword))
+		if creds.HashedPassword != "" {
+			pass = base64.StdEncoding.EncodeToString([]byte(creds.HashedPassword))
 		} else {
-			pass = base64.StdEncoding.EncodeToString([]byte(sha1Hash([]byte(t.config.Credentials.Password))))
+			pass = base64.StdEncoding.EncodeToString([]byte(sha1Hash([]byte(creds.Password))))
 		}
 	} else {
-		pass = base64.StdEncoding.EncodeToString([]byte(t.config.Credentials.Password))
+		pass = base64.StdEncoding.EncodeToString([]byte(creds.Password))
 	}
 
 	return user, pass
@@ -414,19 +684,30 @@ type AesEncryptedSession struct {
 	block cipher.Block
 
 	iv []byte
+
+	// key and IV as received in the handshake, kept for persistence
+	key []byte
 }
 
 func NewAesEncryptedSession(handshakeKey string, key *rsa.PrivateKey) (*AesEncryptedSession, error) {
 	handshakeData, err := base64.StdEncoding.DecodeString(handshakeKey)
 
 	if err != nil {
-		return nil, err
+		return nil, &DecodeError{Operation: "handshake", Stage: DecodeStageBase64, Err: err}
 	}
 
 	keyAndIv, err := key.Decrypt(nil, handshakeData, nil)
 
 	if err != nil {
-		return nil, err
+		return nil, &DecodeError{Operation: "handshake", Stage: DecodeStageRSA, Err: err}
+	}
+
+	return newAesEncryptedSessionFromKey(keyAndIv)
+}
+
+func newAesEncryptedSessionFromKey(keyAndIv []byte) (*AesEncryptedSession, error) {
+	if len(keyAndIv) != 32 {
+		return nil, &DecodeError{Operation: "handshake", Stage: DecodeStageRSA, Err: fmt.Errorf("session key length %d, expected 32", len(keyAndIv))}
 	}
 
 	sessionKey := keyAndIv[:16]
@@ -441,6 +722,7 @@ func NewAesEncryptedSession(handshakeKey string, key *rsa.PrivateKey) (*AesEncry
 	return &AesEncryptedSession{
 		block: block,
 		iv:    sessionIv,
+		key:   keyAndIv,
 	}, nil
 }
 
@@ -461,11 +743,22 @@ func (s *AesEncryptedSession) Encrypt(data []byte) ([]byte, error) {
 }
 
 func (s *AesEncryptedSession) Decrypt(data []byte) ([]byte, error) {
+	// CryptBlocks panics on partial blocks
+	if len(data) == 0 || len(data)%s.block.BlockSize() != 0 {
+		return nil, &DecodeError{Operation: "aes decrypt", Stage: DecodeStageAES, Err: fmt.Errorf("length %d is not a multiple of the block size", len(data))}
+	}
+
 	plaintext := make([]byte, len(data))
 
 	decryptor := cipher.NewCBCDecrypter(s.block, s.iv)
 
 	decryptor.CryptBlocks(plaintext, data)
 
-	return pkcs7Unpad(plaintext, s.block.BlockSize())
+	unpadded, err := pkcs7Unpad(plaintext, s.block.BlockSize())
+
+	if err != nil {
+		return nil, &DecodeError{Operation: "aes decrypt", Stage: DecodeStagePKCS7, Err: err}
+	}
+
+	return unpadded, nil
 }
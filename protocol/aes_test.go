@@ -0,0 +1,384 @@
+package protocol_test
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/device"
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+var credentials = model.Credentials{Username: "user@example.com", Password: "password"}
+
+var (
+	keyOnce sync.Once
+	key     *rsa.PrivateKey
+)
+
+// testKey returns an RSA key shared by the tests, generating keys is slow.
+func testKey(t *testing.T) *rsa.PrivateKey {
+	keyOnce.Do(func() {
+		var err error
+
+		if key, err = protocol.GenerateKey(1024); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	return key
+}
+
+func newDevice(t *testing.T) *devicetest.Device {
+	device := devicetest.NewDevice(credentials)
+	t.Cleanup(device.Close)
+
+	return device
+}
+
+type deviceInfoResponse struct {
+	protocol.AesProtoBaseResponse
+	Result struct {
+		Model    string `json:"model"`
+		DeviceOn bool   `json:"device_on"`
+	} `json:"result"`
+}
+
+func getDeviceInfo(t *testing.T, transport protocol.Protocol) (*deviceInfoResponse, error) {
+	t.Helper()
+
+	var res deviceInfoResponse
+
+	err := transport.SendContext(context.Background(), map[string]interface{}{"method": "get_device_info"}, &res)
+
+	return &res, err
+}
+
+func newAesTransport(t *testing.T, config *model.DeviceConfig) *protocol.AesTransport {
+	transport, err := protocol.NewAesTransport(testKey(t), config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport
+}
+
+func TestAesHandshakeAndLogin(t *testing.T) {
+	device := newDevice(t)
+	transport := newAesTransport(t, device.Config())
+
+	for i := 0; i < 3; i++ {
+		res, err := getDeviceInfo(t, transport)
+
+		if err != nil {
+			t.Fatalf("get_device_info failed: %v", err)
+		}
+
+		if expected := devicetest.DefaultDeviceInfo["model"]; res.Result.Model != expected {
+			t.Errorf("got model %q, expected %q", res.Result.Model, expected)
+		}
+	}
+
+	// the session is reused for later requests
+	if calls := device.Calls("handshake"); calls != 1 {
+		t.Errorf("got %d handshakes, expected 1", calls)
+	}
+
+	if calls := device.Calls("login_device"); calls != 1 {
+		t.Errorf("got %d logins, expected 1", calls)
+	}
+
+	if calls := device.Calls("get_device_info"); calls != 3 {
+		t.Errorf("got %d requests, expected 3", calls)
+	}
+}
+
+func TestAesLoginVersion(t *testing.T) {
+	tests := []struct {
+		name          string
+		deviceVersion int
+		configVersion int
+		expected      int
+	}{
+		{"v2", 2, 2, 2},
+		{"v1", 1, 1, 1},
+		{"fallback to v1", 1, 2, 1},
+		{"fallback to v2", 2, 1, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := newDevice(t)
+			device.LoginVersion = tt.deviceVersion
+
+			config := device.Config()
+			config.LoginVersion = tt.configVersion
+
+			transport := newAesTransport(t, config)
+
+			if _, err := getDeviceInfo(t, transport); err != nil {
+				t.Fatalf("get_device_info failed: %v", err)
+			}
+
+			if version, _ := transport.Login(); version != tt.expected {
+				t.Errorf("logged in with version %d, expected %d", version, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAesInvalidCredentials(t *testing.T) {
+	device := newDevice(t)
+
+	config := device.Config()
+	config.Credentials = &model.Credentials{Username: credentials.Username, Password: "wrong"}
+
+	_, err := getDeviceInfo(t, newAesTransport(t, config))
+
+	if !errors.Is(err, protocol.ErrAuthentication) {
+		t.Fatalf("got %v, expected an authentication error", err)
+	}
+
+	if calls := device.Calls("get_device_info"); calls != 0 {
+		t.Errorf("got %d requests without a login, expected none", calls)
+	}
+}
+
+func TestAesDefaultCredentials(t *testing.T) {
+	device := devicetest.NewDevice(model.DefaultCredentials[0])
+	t.Cleanup(device.Close)
+
+	config := device.Config()
+	config.Credentials = &credentials
+	config.TryDefaultCredentials = true
+
+	transport := newAesTransport(t, config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	if _, creds := transport.Login(); *creds != model.DefaultCredentials[0] {
+		t.Errorf("logged in as %q, expected the default credentials", creds.Username)
+	}
+}
+
+func TestAesSessionExpiry(t *testing.T) {
+	device := newDevice(t)
+	transport := newAesTransport(t, device.Config())
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	device.ExpireSessions()
+
+	// without a retry policy the expiry is reported, and the next request
+	// starts a new session
+	_, err := getDeviceInfo(t, transport)
+
+	if !errors.Is(err, protocol.ErrSessionExpired) {
+		t.Fatalf("got %v, expected the session to expire", err)
+	}
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed after the session expired: %v", err)
+	}
+
+	if calls := device.Calls("handshake"); calls != 2 {
+		t.Errorf("got %d handshakes, expected 2", calls)
+	}
+}
+
+func TestAesSessionExpiryRetried(t *testing.T) {
+	device := newDevice(t)
+
+	config := device.Config()
+	config.Retry = &model.DefaultRetryPolicy
+
+	transport := newAesTransport(t, config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	device.ExpireSessions()
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("expired session was not retried: %v", err)
+	}
+
+	if calls := device.Calls("handshake"); calls != 2 {
+		t.Errorf("got %d handshakes, expected 2", calls)
+	}
+}
+
+func TestAesErrorCodes(t *testing.T) {
+	tests := []struct {
+		code     protocol.ErrorCode
+		expected error
+	}{
+		{protocol.ErrorCodeUnknownMethod, protocol.ErrUnsupportedMethod},
+		{protocol.ErrorCodeInvalidParams, protocol.ErrInvalidRequest},
+		{protocol.ErrorCodeCommonFailed, protocol.ErrDeviceFailure},
+		{protocol.ErrorCodeSessionTimeout, protocol.ErrSessionExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code.String(), func(t *testing.T) {
+			fake := newDevice(t)
+
+			dev := device.NewDeviceWithTransport(fake.Config(), newAesTransport(t, fake.Config()))
+
+			fake.InjectFault(devicetest.Fault{Method: "get_device_info", ErrorCode: tt.code, Times: 1})
+
+			_, err := dev.GetDeviceInfo(context.Background())
+
+			var deviceErr *protocol.DeviceError
+
+			if !errors.As(err, &deviceErr) {
+				t.Fatalf("got %v, expected a device error", err)
+			}
+
+			if deviceErr.Method != "get_device_info" || deviceErr.Code != tt.code {
+				t.Errorf("got %s failing with %d, expected get_device_info failing with %d", deviceErr.Method, deviceErr.Code, tt.code)
+			}
+
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("got %v, expected %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAesPassthroughErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		fault      devicetest.Fault
+		expected   error
+		handshakes int
+	}{
+		{
+			name:       "status",
+			fault:      devicetest.Fault{Method: "securePassthrough", StatusCode: 500, Times: 1},
+			expected:   protocol.ErrTransient,
+			handshakes: 1,
+		},
+		{
+			name:       "error code",
+			fault:      devicetest.Fault{Method: "securePassthrough", ErrorCode: protocol.ErrorCodeSessionTimeout, Times: 1},
+			expected:   protocol.ErrSessionExpired,
+			handshakes: 2,
+		},
+		{
+			name:       "device error",
+			fault:      devicetest.Fault{Method: "get_device_info", ErrorCode: protocol.ErrorCodeInvalidParams, Times: 1},
+			expected:   nil,
+			handshakes: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := newDevice(t)
+			transport := newAesTransport(t, device.Config())
+
+			if _, err := getDeviceInfo(t, transport); err != nil {
+				t.Fatalf("get_device_info failed: %v", err)
+			}
+
+			device.InjectFault(tt.fault)
+
+			_, err := getDeviceInfo(t, transport)
+
+			if tt.expected == nil && err != nil {
+				t.Fatalf("got %v, expected the error code in the response", err)
+			}
+
+			if tt.expected != nil && !errors.Is(err, tt.expected) {
+				t.Fatalf("got %v, expected %v", err, tt.expected)
+			}
+
+			if _, err := getDeviceInfo(t, transport); err != nil {
+				t.Fatalf("get_device_info failed after the error: %v", err)
+			}
+
+			if calls := device.Calls("handshake"); calls != tt.handshakes {
+				t.Errorf("got %d handshakes, expected %d", calls, tt.handshakes)
+			}
+		})
+	}
+}
+
+// TestAesTransientRetried expects a transient error to be retried on the
+// current session, as the default policy says.
+func TestAesTransientRetried(t *testing.T) {
+	device := newDevice(t)
+
+	config := device.Config()
+	config.Retry = &model.DefaultRetryPolicy
+
+	transport := newAesTransport(t, config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	device.InjectFault(devicetest.Fault{Method: "securePassthrough", StatusCode: 500, Times: 1})
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("transient error was not retried: %v", err)
+	}
+
+	if calls := device.Calls("handshake"); calls != 1 {
+		t.Errorf("got %d handshakes, expected 1", calls)
+	}
+
+	if calls := device.Calls("login_device"); calls != 1 {
+		t.Errorf("got %d logins, expected 1", calls)
+	}
+}
+
+// TestAesUnexpectedResult expects a response that doesn't fit the result
+// to be returned as is, without a retry or a new session.
+func TestAesUnexpectedResult(t *testing.T) {
+	device := newDevice(t)
+
+	config := device.Config()
+	config.Retry = &model.DefaultRetryPolicy
+
+	transport := newAesTransport(t, config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	device.Handle("get_device_info", devicetest.Result(map[string]interface{}{
+		"model": 110,
+	}))
+
+	_, err := getDeviceInfo(t, transport)
+
+	var decodeErr *protocol.DecodeError
+
+	if !errors.As(err, &decodeErr) || decodeErr.Stage != protocol.DecodeStageResult {
+		t.Fatalf("got %v, expected a result decode error", err)
+	}
+
+	if class := protocol.Classify(err); class != protocol.ErrorClassDevice {
+		t.Errorf("got class %s, expected %s", class, protocol.ErrorClassDevice)
+	}
+
+	if calls := device.Calls("get_device_info"); calls != 2 {
+		t.Errorf("got %d requests, expected 2", calls)
+	}
+
+	if calls := device.Calls("handshake"); calls != 1 {
+		t.Errorf("got %d handshakes, expected 1", calls)
+	}
+}
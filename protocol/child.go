@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+)
+
+var _ Protocol = (*ChildTransport)(nil)
+
+// ChildTransport sends requests to a child of a power strip or hub, such
+// as an outlet or a sensor, by wrapping them in control_child requests to
+// the parent. Legacy parents address the child with the context of the
+// query instead, which the legacy transport does for control_child.
+type ChildTransport struct {
+	parent   Protocol
+	deviceId string
+
+	closed atomic.Bool
+}
+
+type childRequest struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type controlChildParams struct {
+	DeviceId    string      `json:"device_id"`
+	RequestData interface{} `json:"requestData"`
+}
+
+type controlChildResponse struct {
+	AesProtoBaseResponse
+	Result struct {
+		ResponseData json.RawMessage `json:"responseData"`
+	} `json:"result"`
+}
+
+// NewChildTransport returns a transport for the child with the given
+// device id, sharing the session of the parent transport.
+func NewChildTransport(parent Protocol, deviceId string) *ChildTransport {
+	return &ChildTransport{
+		parent:   parent,
+		deviceId: deviceId,
+	}
+}
+
+func (t *ChildTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *ChildTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	marshalledRequest, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	var res controlChildResponse
+
+	// the request is relayed as it is, a single request or a
+	// multipleRequest, and so is its response
+	err = t.parent.SendContext(ctx, &childRequest{
+		Method: "control_child",
+		Params: &controlChildParams{
+			DeviceId:    t.deviceId,
+			RequestData: json.RawMessage(marshalledRequest),
+		},
+	}, &res)
+
+	if err != nil {
+		return err
+	}
+
+	if res.ErrorCode != 0 {
+		return &DeviceError{Method: "control_child", Code: ErrorCode(res.ErrorCode)}
+	}
+
+	if len(res.Result.ResponseData) == 0 {
+		return &DecodeError{Operation: "control_child", Stage: DecodeStageResult, Err: errors.New("no response from child")}
+	}
+
+	if err := json.Unmarshal(res.Result.ResponseData, response); err != nil {
+		return &DecodeError{Operation: "control_child", Stage: DecodeStageResult, Err: err}
+	}
+
+	return nil
+}
+
+// Close only closes the child, the parent transport is closed by its
+// owner.
+func (t *ChildTransport) Close() error {
+	t.closed.Store(true)
+
+	return nil
+}
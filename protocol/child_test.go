@@ -0,0 +1,214 @@
+package protocol_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+type childInfoResponse struct {
+	protocol.AesProtoBaseResponse
+	Result struct {
+		DeviceId string `json:"device_id"`
+		DeviceOn bool   `json:"device_on"`
+		Model    string `json:"model"`
+	} `json:"result"`
+}
+
+func getChildInfo(t *testing.T, transport protocol.Protocol) *childInfoResponse {
+	t.Helper()
+
+	var res childInfoResponse
+
+	if err := transport.SendContext(context.Background(), map[string]interface{}{"method": "get_device_info"}, &res); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	return &res
+}
+
+func setChildOn(t *testing.T, transport protocol.Protocol, on bool) {
+	t.Helper()
+
+	var res protocol.AesProtoBaseResponse
+
+	err := transport.SendContext(context.Background(), map[string]interface{}{
+		"method": "set_device_info",
+		"params": map[string]interface{}{"device_on": on},
+	}, &res)
+
+	if err != nil {
+		t.Fatalf("set_device_info failed: %v", err)
+	}
+
+	if res.ErrorCode != 0 {
+		t.Fatalf("set_device_info failed with error code %d", res.ErrorCode)
+	}
+}
+
+func newStrip(t *testing.T) (*devicetest.Device, *devicetest.Device) {
+	parent := newDevice(t)
+	child := newDevice(t)
+
+	parent.AddChild("child", child)
+
+	return parent, child
+}
+
+// TestChildSingleRequest expects single requests to be relayed as they
+// are, without a multipleRequest around them.
+func TestChildSingleRequest(t *testing.T) {
+	parent, child := newStrip(t)
+
+	transport := protocol.NewChildTransport(newAesTransport(t, parent.Config()), "child")
+
+	if res := getChildInfo(t, transport); res.Result.Model != devicetest.DefaultDeviceInfo["model"] {
+		t.Errorf("got model %q, expected %q", res.Result.Model, devicetest.DefaultDeviceInfo["model"])
+	}
+
+	if calls := parent.Calls("control_child"); calls != 1 {
+		t.Errorf("got %d control_child requests, expected 1", calls)
+	}
+
+	if calls := child.Calls("get_device_info"); calls != 1 {
+		t.Errorf("got %d requests to the child, expected 1", calls)
+	}
+
+	if calls := child.Calls("multipleRequest"); calls != 0 {
+		t.Errorf("got %d multipleRequest for a single request, expected none", calls)
+	}
+}
+
+func TestChildMultipleRequest(t *testing.T) {
+	parent, child := newStrip(t)
+
+	transport := protocol.NewChildTransport(newAesTransport(t, parent.Config()), "child")
+
+	var res struct {
+		protocol.AesProtoBaseResponse
+		Result struct {
+			Responses []struct {
+				Method    string          `json:"method"`
+				ErrorCode int             `json:"error_code"`
+				Result    json.RawMessage `json:"result"`
+			} `json:"responses"`
+		} `json:"result"`
+	}
+
+	err := transport.SendContext(context.Background(), map[string]interface{}{
+		"method": "multipleRequest",
+		"params": map[string]interface{}{
+			"requests": []map[string]interface{}{
+				{"method": "get_device_info"},
+				{"method": "get_energy_usage"},
+			},
+		},
+	}, &res)
+
+	if err != nil {
+		t.Fatalf("multipleRequest failed: %v", err)
+	}
+
+	if len(res.Result.Responses) != 2 {
+		t.Fatalf("got %d responses, expected 2", len(res.Result.Responses))
+	}
+
+	for i, method := range []string{"get_device_info", "get_energy_usage"} {
+		if got := res.Result.Responses[i]; got.Method != method || got.ErrorCode != 0 {
+			t.Errorf("got %s with error code %d, expected %s", got.Method, got.ErrorCode, method)
+		}
+	}
+
+	if calls := child.Calls("multipleRequest"); calls != 1 {
+		t.Errorf("got %d multipleRequest, expected 1", calls)
+	}
+}
+
+func TestChildUnknown(t *testing.T) {
+	parent, _ := newStrip(t)
+
+	transport := protocol.NewChildTransport(newAesTransport(t, parent.Config()), "unknown")
+
+	_, err := getDeviceInfo(t, transport)
+
+	var deviceErr *protocol.DeviceError
+
+	if !errors.As(err, &deviceErr) || deviceErr.Method != "control_child" {
+		t.Fatalf("got %v, expected control_child to fail", err)
+	}
+}
+
+func newLegacyStrip(t *testing.T) (*devicetest.Device, map[string]*devicetest.Device) {
+	parent := devicetest.NewLegacyDevice()
+	t.Cleanup(parent.Close)
+
+	children := make(map[string]*devicetest.Device)
+
+	for _, id := range []string{"00", "01"} {
+		children[id] = newDevice(t)
+		parent.AddChild(id, children[id])
+	}
+
+	return parent, children
+}
+
+// TestLegacyChild expects the outlets of legacy strips to be addressed
+// with the context of the query.
+func TestLegacyChild(t *testing.T) {
+	parent, children := newLegacyStrip(t)
+
+	legacy, err := protocol.NewLegacyTransport(parent.Config())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := protocol.NewChildTransport(legacy, "01")
+
+	res := getChildInfo(t, transport)
+
+	if res.Result.DeviceId != "01" || !res.Result.DeviceOn {
+		t.Errorf("got device %q on %t, expected outlet 01 to be on", res.Result.DeviceId, res.Result.DeviceOn)
+	}
+
+	// outlets share the details of the strip
+	if res.Result.Model != devicetest.DefaultDeviceInfo["model"] {
+		t.Errorf("got model %q, expected %q", res.Result.Model, devicetest.DefaultDeviceInfo["model"])
+	}
+
+	setChildOn(t, transport, false)
+
+	if calls := children["01"].Calls("set_device_info"); calls != 1 {
+		t.Errorf("got %d set_device_info for the outlet, expected 1", calls)
+	}
+
+	if calls := children["00"].Calls("set_device_info") + parent.Calls("set_device_info"); calls != 0 {
+		t.Errorf("switched %d other devices, expected only the outlet", calls)
+	}
+
+	if res := getChildInfo(t, transport); res.Result.DeviceOn {
+		t.Errorf("outlet still on after switching it off")
+	}
+
+	if res := getChildInfo(t, protocol.NewChildTransport(legacy, "00")); !res.Result.DeviceOn {
+		t.Errorf("outlet 00 off after switching off outlet 01")
+	}
+}
+
+func TestLegacyChildUnknown(t *testing.T) {
+	parent, _ := newLegacyStrip(t)
+
+	legacy, err := protocol.NewLegacyTransport(parent.Config())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := getChildInfo(t, protocol.NewChildTransport(legacy, "02")); res.ErrorCode == 0 {
+		t.Errorf("got %+v for an unknown outlet, expected an error code", res.Result)
+	}
+}
@@ -0,0 +1,299 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/model"
+)
+
+var _ Protocol = (*CloudTransport)(nil)
+
+const DefaultCloudURL = "https://wap.tplinkcloud.com"
+
+// CloudTransport sends requests through the passthrough API of the
+// TP-Link cloud, for devices that can't be reached on the local network.
+// The address of the config is the id of the device.
+type CloudTransport struct {
+	config *model.DeviceConfig
+
+	url          string
+	terminalUUID string
+	token        string
+
+	httpClient *http.Client
+
+	closed   atomic.Bool
+	sendLock sendLock
+}
+
+type cloudRequest struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type cloudLoginParams struct {
+	AppType       string `json:"appType"`
+	CloudUserName string `json:"cloudUserName"`
+	CloudPassword string `json:"cloudPassword"`
+	TerminalUUID  string `json:"terminalUUID"`
+}
+
+type cloudLoginResponse struct {
+	AesProtoBaseResponse
+	Message string `json:"msg"`
+	Result  struct {
+		Token string `json:"token"`
+	} `json:"result"`
+}
+
+type cloudPassthroughParams struct {
+	DeviceId    string `json:"deviceId"`
+	RequestData string `json:"requestData"`
+}
+
+type cloudPassthroughResponse struct {
+	AesProtoBaseResponse
+	Message string `json:"msg"`
+	Result  struct {
+		ResponseData string `json:"responseData"`
+	} `json:"result"`
+}
+
+func NewCloudTransport(config *model.DeviceConfig) (*CloudTransport, error) {
+	// the cloud login needs the plain password
+	if config.Credentials == nil || config.Credentials.Password == "" {
+		return nil, fmt.Errorf("cloud transport needs the password, not the hashed password")
+	}
+
+	cloudURL := config.CloudURL
+
+	if cloudURL == "" {
+		cloudURL = DefaultCloudURL
+	}
+
+	httpClient, err := NewHTTPClient(config.HTTP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &CloudTransport{
+		config:       config,
+		url:          cloudURL,
+		terminalUUID: newUUID(),
+		httpClient:   httpClient,
+		sendLock:     newSendLock(),
+	}, nil
+}
+
+func (t *CloudTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *CloudTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if err := t.sendLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer t.sendLock.Unlock()
+
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	return withRetry(ctx, t.config.Retry, t.config.Address, t.resetSession, func() error {
+		return t.send(ctx, request, response)
+	})
+}
+
+func (t *CloudTransport) send(ctx context.Context, request, response interface{}) error {
+	if t.token == "" {
+		if err := t.login(ctx); err != nil {
+			return err
+		}
+	}
+
+	err := t.passthrough(ctx, request, response)
+
+	if err != nil && ctx.Err() == nil && Classify(err) == ErrorClassSession {
+		t.resetSession()
+	}
+
+	return err
+}
+
+func (t *CloudTransport) resetSession() {
+	t.token = ""
+}
+
+func (t *CloudTransport) Close() error {
+	t.closed.Store(true)
+	t.httpClient.CloseIdleConnections()
+
+	return nil
+}
+
+func (t *CloudTransport) login(ctx context.Context) error {
+	logger.Debug("msg", "performing cloud login", "target", t.config.Address, "url", t.url)
+
+	start := time.Now()
+
+	var res cloudLoginResponse
+
+	_, err := t.post(ctx, t.url, &cloudRequest{
+		Method: "login",
+		Params: &cloudLoginParams{
+			AppType:       "Kasa_Android",
+			CloudUserName: t.config.Credentials.Username,
+			CloudPassword: t.config.Credentials.Password,
+			TerminalUUID:  t.terminalUUID,
+		},
+	}, &res)
+
+	if err == nil && res.ErrorCode != 0 {
+		err = &DeviceError{Method: "login", Code: ErrorCode(res.ErrorCode)}
+	}
+
+	observerFor(t.config).LoginFinished(model.LoginEvent{
+		Address:   t.config.Address,
+		Transport: TransportCloud,
+		Duration:  time.Since(start),
+		Err:       err,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	t.token = res.Result.Token
+
+	return nil
+}
+
+func (t *CloudTransport) passthrough(ctx context.Context, request, response interface{}) error {
+	marshalledRequest, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	event := &model.RequestEvent{
+		Address:   t.config.Address,
+		Transport: TransportCloud,
+		Method:    requestMethod(marshalledRequest),
+	}
+
+	start := time.Now()
+
+	data, err := t.exchange(ctx, marshalledRequest, event)
+
+	if err == nil {
+		if err = json.Unmarshal(data, response); err != nil {
+			err = &DecodeError{Operation: "passthrough", Stage: DecodeStageResult, Err: err}
+		}
+	}
+
+	finishRequest(t.config, event, start, data, err)
+
+	return err
+}
+
+// exchange sends the request to the device and returns its response.
+func (t *CloudTransport) exchange(ctx context.Context, marshalledRequest []byte, event *model.RequestEvent) ([]byte, error) {
+	passthroughURL, err := url.Parse(t.url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := passthroughURL.Query()
+	query.Set("token", t.token)
+	passthroughURL.RawQuery = query.Encode()
+
+	logger.Debug("msg", "sending cloud request", "target", t.config.Address, "request", string(marshalledRequest))
+
+	var res cloudPassthroughResponse
+
+	event.RequestBytes, err = t.post(ctx, passthroughURL.String(), &cloudRequest{
+		Method: "passthrough",
+		Params: &cloudPassthroughParams{
+			DeviceId:    t.config.Address,
+			RequestData: string(marshalledRequest),
+		},
+	}, &res)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.ErrorCode != 0 {
+		return nil, &DeviceError{Method: "passthrough", Code: ErrorCode(res.ErrorCode)}
+	}
+
+	event.ResponseBytes = len(res.Result.ResponseData)
+
+	logger.Debug("msg", "received cloud response", "target", t.config.Address, "response", res.Result.ResponseData)
+
+	return []byte(res.Result.ResponseData), nil
+}
+
+// post sends a cloud request and returns the size of the request.
+func (t *CloudTransport) post(ctx context.Context, url string, request, response interface{}) (int, error) {
+	marshalled, err := json.Marshal(request)
+
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(marshalled))
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := t.httpClient.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return 0, &StatusError{Operation: "cloud " + request.(*cloudRequest).Method, StatusCode: res.StatusCode}
+	}
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := json.Unmarshal(body, response); err != nil {
+		return 0, &DecodeError{Operation: "cloud " + request.(*cloudRequest).Method, Stage: DecodeStageJSON, Err: err}
+	}
+
+	return len(marshalled), nil
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
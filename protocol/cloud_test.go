@@ -0,0 +1,156 @@
+package protocol_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+func newCloud(t *testing.T) (*devicetest.Cloud, *devicetest.Device) {
+	device := newDevice(t)
+
+	cloud := devicetest.NewCloud(credentials)
+	t.Cleanup(cloud.Close)
+
+	cloud.AddDevice("device", device)
+
+	return cloud, device
+}
+
+func newCloudTransport(t *testing.T, config *model.DeviceConfig) *protocol.CloudTransport {
+	transport, err := protocol.NewCloudTransport(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport
+}
+
+func TestCloudRequest(t *testing.T) {
+	cloud, device := newCloud(t)
+	transport := newCloudTransport(t, cloud.Config("device"))
+
+	for i := 0; i < 3; i++ {
+		res, err := getDeviceInfo(t, transport)
+
+		if err != nil {
+			t.Fatalf("get_device_info failed: %v", err)
+		}
+
+		if expected := devicetest.DefaultDeviceInfo["model"]; res.Result.Model != expected {
+			t.Errorf("got model %q, expected %q", res.Result.Model, expected)
+		}
+	}
+
+	// the token is reused for later requests
+	if calls := cloud.Calls("login"); calls != 1 {
+		t.Errorf("got %d logins, expected 1", calls)
+	}
+
+	if calls := device.Calls("get_device_info"); calls != 3 {
+		t.Errorf("got %d requests, expected 3", calls)
+	}
+}
+
+func TestCloudTokenExpiry(t *testing.T) {
+	cloud, _ := newCloud(t)
+	transport := newCloudTransport(t, cloud.Config("device"))
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	cloud.ExpireTokens()
+
+	// without a retry policy the expiry is reported, and the next request
+	// logs in again
+	_, err := getDeviceInfo(t, transport)
+
+	if !errors.Is(err, protocol.ErrSessionExpired) {
+		t.Fatalf("got %v, expected the token to expire", err)
+	}
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed after the token expired: %v", err)
+	}
+
+	if calls := cloud.Calls("login"); calls != 2 {
+		t.Errorf("got %d logins, expected 2", calls)
+	}
+}
+
+func TestCloudTokenExpiryRetried(t *testing.T) {
+	cloud, _ := newCloud(t)
+
+	config := cloud.Config("device")
+	config.Retry = &model.DefaultRetryPolicy
+
+	transport := newCloudTransport(t, config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	cloud.ExpireTokens()
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("expired token was not retried: %v", err)
+	}
+
+	if calls := cloud.Calls("login"); calls != 2 {
+		t.Errorf("got %d logins, expected 2", calls)
+	}
+}
+
+func TestCloudErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   func(config *model.DeviceConfig)
+		expected error
+	}{
+		{
+			name: "invalid credentials",
+			config: func(config *model.DeviceConfig) {
+				config.Credentials = &model.Credentials{Username: credentials.Username, Password: "wrong"}
+			},
+			expected: protocol.ErrAuthentication,
+		},
+		{
+			name: "device offline",
+			config: func(config *model.DeviceConfig) {
+				config.Address = "unknown"
+			},
+			expected: protocol.ErrTransient,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cloud, _ := newCloud(t)
+
+			config := cloud.Config("device")
+			tt.config(config)
+
+			_, err := getDeviceInfo(t, newCloudTransport(t, config))
+
+			if !errors.Is(err, tt.expected) {
+				t.Errorf("got %v, expected %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCloudHashedPassword(t *testing.T) {
+	cloud, _ := newCloud(t)
+
+	config := cloud.Config("device")
+	config.Credentials = &model.Credentials{Username: credentials.Username, HashedPassword: "hash"}
+
+	if _, err := protocol.NewCloudTransport(config); err == nil {
+		t.Errorf("created a cloud transport without the password")
+	}
+}
@@ -0,0 +1,28 @@
+package protocol_test
+
+import (
+	"testing"
+
+	"github.com/dehydr8/kasa-go/protocoltest"
+)
+
+func TestConformance(t *testing.T) {
+	tests := []struct {
+		name    string
+		factory protocoltest.Factory
+	}{
+		{"Aes", protocoltest.Aes(testKey(t))},
+		{"Klap", protocoltest.Klap()},
+		{"Legacy", protocoltest.Legacy()},
+		{"Tls", protocoltest.Tls()},
+		{"Cloud", protocoltest.Cloud()},
+		{"Child", protocoltest.Child(testKey(t))},
+		{"ScheduledAes", protocoltest.Scheduled(protocoltest.Aes(testKey(t)))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protocoltest.Run(t, tt.factory)
+		})
+	}
+}
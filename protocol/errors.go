@@ -0,0 +1,382 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrorCode is an error code returned by SMART devices, either for the
+// transport (handshake, login, passthrough) or for a method.
+type ErrorCode int
+
+const (
+	ErrorCodeSuccess ErrorCode = 0
+
+	// transport errors
+	ErrorCodeSessionExpired        ErrorCode = 9999
+	ErrorCodeMultiRequestFailed    ErrorCode = 1200
+	ErrorCodeHttpTransportFailed   ErrorCode = 1112
+	ErrorCodeLoginFailed           ErrorCode = 1111
+	ErrorCodeHandshakeFailed       ErrorCode = 1100
+	ErrorCodeProtocolNotSupported  ErrorCode = 1003
+	ErrorCodeTransportNotAvailable ErrorCode = 1002
+	ErrorCodeCommandCancelled      ErrorCode = 1001
+	ErrorCodeNullTransport         ErrorCode = 1000
+
+	// method errors
+	ErrorCodeCommonFailed       ErrorCode = -1
+	ErrorCodeUnspecific         ErrorCode = -1001
+	ErrorCodeUnknownMethod      ErrorCode = -1002
+	ErrorCodeJsonDecodeFailed   ErrorCode = -1003
+	ErrorCodeJsonEncodeFailed   ErrorCode = -1004
+	ErrorCodeAesDecodeFailed    ErrorCode = -1005
+	ErrorCodeRequestLength      ErrorCode = -1006
+	ErrorCodeCloudFailed        ErrorCode = -1007
+	ErrorCodeInvalidParams      ErrorCode = -1008
+	ErrorCodeSessionTimeout     ErrorCode = -1010
+	ErrorCodeSessionParams      ErrorCode = -1101
+	ErrorCodeQuickSetup         ErrorCode = -1201
+	ErrorCodeDevice             ErrorCode = -1301
+	ErrorCodeDeviceNextEvent    ErrorCode = -1302
+	ErrorCodeFirmware           ErrorCode = -1401
+	ErrorCodeFirmwareVersion    ErrorCode = -1402
+	ErrorCodeInvalidCredentials ErrorCode = -1501
+	ErrorCodeTime               ErrorCode = -1601
+	ErrorCodeTimeSystem         ErrorCode = -1602
+	ErrorCodeTimeSave           ErrorCode = -1603
+	ErrorCodeWireless           ErrorCode = -1701
+	ErrorCodeWirelessUnsupport  ErrorCode = -1702
+	ErrorCodeSchedule           ErrorCode = -1801
+	ErrorCodeScheduleFull       ErrorCode = -1802
+	ErrorCodeScheduleConflict   ErrorCode = -1803
+	ErrorCodeScheduleSave       ErrorCode = -1804
+	ErrorCodeScheduleIndex      ErrorCode = -1805
+	ErrorCodeCountdown          ErrorCode = -1901
+	ErrorCodeCountdownConflict  ErrorCode = -1902
+	ErrorCodeCountdownSave      ErrorCode = -1903
+	ErrorCodeAntitheft          ErrorCode = -2001
+	ErrorCodeAntitheftConflict  ErrorCode = -2002
+	ErrorCodeAntitheftSave      ErrorCode = -2003
+	ErrorCodeAccount            ErrorCode = -2101
+	ErrorCodeStat               ErrorCode = -2201
+	ErrorCodeStatSave           ErrorCode = -2202
+	ErrorCodeDst                ErrorCode = -2301
+	ErrorCodeDstSave            ErrorCode = -2302
+
+	// returned by the cloud
+	ErrorCodeCloudTokenExpired       ErrorCode = -20651
+	ErrorCodeCloudInvalidCredentials ErrorCode = -20601
+	ErrorCodeCloudDeviceOffline      ErrorCode = -20571
+)
+
+type errorCodeInfo struct {
+	name  string
+	class ErrorClass
+}
+
+var errorCodes = map[ErrorCode]errorCodeInfo{
+	ErrorCodeSuccess: {"success", ErrorClassUnknown},
+
+	ErrorCodeSessionExpired:        {"session expired", ErrorClassSession},
+	ErrorCodeMultiRequestFailed:    {"multiple request failed", ErrorClassTransient},
+	ErrorCodeHttpTransportFailed:   {"http transport failed", ErrorClassTransient},
+	ErrorCodeLoginFailed:           {"login failed", ErrorClassAuthentication},
+	ErrorCodeHandshakeFailed:       {"handshake failed", ErrorClassAuthentication},
+	ErrorCodeProtocolNotSupported:  {"protocol not supported", ErrorClassProtocol},
+	ErrorCodeTransportNotAvailable: {"transport not available", ErrorClassTransient},
+	ErrorCodeCommandCancelled:      {"command cancelled", ErrorClassTransient},
+	ErrorCodeNullTransport:         {"null transport", ErrorClassTransient},
+
+	ErrorCodeCommonFailed:       {"common failure", ErrorClassDevice},
+	ErrorCodeUnspecific:         {"unspecific error", ErrorClassTransient},
+	ErrorCodeUnknownMethod:      {"unknown method", ErrorClassUnsupportedMethod},
+	ErrorCodeJsonDecodeFailed:   {"json decode failed", ErrorClassInvalidRequest},
+	ErrorCodeJsonEncodeFailed:   {"json encode failed", ErrorClassInvalidRequest},
+	ErrorCodeAesDecodeFailed:    {"aes decode failed", ErrorClassSession},
+	ErrorCodeRequestLength:      {"invalid request length", ErrorClassInvalidRequest},
+	ErrorCodeCloudFailed:        {"cloud failure", ErrorClassDevice},
+	ErrorCodeInvalidParams:      {"invalid params", ErrorClassInvalidRequest},
+	ErrorCodeSessionTimeout:     {"session timeout", ErrorClassSession},
+	ErrorCodeSessionParams:      {"invalid session params", ErrorClassSession},
+	ErrorCodeQuickSetup:         {"quick setup error", ErrorClassDevice},
+	ErrorCodeDevice:             {"device error", ErrorClassDevice},
+	ErrorCodeDeviceNextEvent:    {"device next event error", ErrorClassDevice},
+	ErrorCodeFirmware:           {"firmware error", ErrorClassDevice},
+	ErrorCodeFirmwareVersion:    {"firmware version error", ErrorClassDevice},
+	ErrorCodeInvalidCredentials: {"invalid credentials", ErrorClassAuthentication},
+	ErrorCodeTime:               {"time error", ErrorClassDevice},
+	ErrorCodeTimeSystem:         {"system time error", ErrorClassDevice},
+	ErrorCodeTimeSave:           {"time save error", ErrorClassDevice},
+	ErrorCodeWireless:           {"wireless error", ErrorClassDevice},
+	ErrorCodeWirelessUnsupport:  {"wireless unsupported", ErrorClassUnsupportedMethod},
+	ErrorCodeSchedule:           {"schedule error", ErrorClassDevice},
+	ErrorCodeScheduleFull:       {"schedule full", ErrorClassDevice},
+	ErrorCodeScheduleConflict:   {"schedule conflict", ErrorClassDevice},
+	ErrorCodeScheduleSave:       {"schedule save error", ErrorClassDevice},
+	ErrorCodeScheduleIndex:      {"schedule index error", ErrorClassInvalidRequest},
+	ErrorCodeCountdown:          {"countdown error", ErrorClassDevice},
+	ErrorCodeCountdownConflict:  {"countdown conflict", ErrorClassDevice},
+	ErrorCodeCountdownSave:      {"countdown save error", ErrorClassDevice},
+	ErrorCodeAntitheft:          {"antitheft error", ErrorClassDevice},
+	ErrorCodeAntitheftConflict:  {"antitheft conflict", ErrorClassDevice},
+	ErrorCodeAntitheftSave:      {"antitheft save error", ErrorClassDevice},
+	ErrorCodeAccount:            {"account error", ErrorClassDevice},
+	ErrorCodeStat:               {"stat error", ErrorClassDevice},
+	ErrorCodeStatSave:           {"stat save error", ErrorClassDevice},
+	ErrorCodeDst:                {"dst error", ErrorClassDevice},
+	ErrorCodeDstSave:            {"dst save error", ErrorClassDevice},
+
+	ErrorCodeCloudTokenExpired:       {"cloud token expired", ErrorClassSession},
+	ErrorCodeCloudInvalidCredentials: {"incorrect email or password", ErrorClassAuthentication},
+	ErrorCodeCloudDeviceOffline:      {"device is offline", ErrorClassTransient},
+}
+
+func (c ErrorCode) String() string {
+	if info, ok := errorCodes[c]; ok {
+		return info.name
+	}
+
+	return "unknown error"
+}
+
+// Class returns how an error with this code should be treated.
+func (c ErrorCode) Class() ErrorClass {
+	if info, ok := errorCodes[c]; ok {
+		return info.class
+	}
+
+	return ErrorClassUnknown
+}
+
+type ErrorClass int
+
+const (
+	ErrorClassUnknown ErrorClass = iota
+
+	// the credentials were rejected
+	ErrorClassAuthentication
+
+	// the session is no longer valid and a new handshake is needed
+	ErrorClassSession
+
+	// the request may succeed if tried again
+	ErrorClassTransient
+
+	// the device does not speak the protocol of the transport
+	ErrorClassProtocol
+
+	// the device does not know the method
+	ErrorClassUnsupportedMethod
+
+	// the device rejected the request parameters
+	ErrorClassInvalidRequest
+
+	// the device failed to carry out the request
+	ErrorClassDevice
+)
+
+// Sentinels for the error classes, every error of a class matches the
+// class sentinel with errors.Is.
+var (
+	ErrAuthentication      = errors.New("authentication failed")
+	ErrSessionExpired      = errors.New("session expired")
+	ErrTransient           = errors.New("transient error")
+	ErrUnsupportedMethod   = errors.New("method not supported by device")
+	ErrInvalidRequest      = errors.New("invalid request")
+	ErrDeviceFailure       = errors.New("device failure")
+	ErrUnsupportedProtocol = errors.New("protocol not supported by device")
+)
+
+var classSentinels = []struct {
+	class    ErrorClass
+	sentinel error
+}{
+	{ErrorClassAuthentication, ErrAuthentication},
+	{ErrorClassSession, ErrSessionExpired},
+	{ErrorClassTransient, ErrTransient},
+	{ErrorClassProtocol, ErrUnsupportedProtocol},
+	{ErrorClassUnsupportedMethod, ErrUnsupportedMethod},
+	{ErrorClassInvalidRequest, ErrInvalidRequest},
+	{ErrorClassDevice, ErrDeviceFailure},
+}
+
+func (c ErrorClass) sentinel() error {
+	for _, s := range classSentinels {
+		if s.class == c {
+			return s.sentinel
+		}
+	}
+
+	return nil
+}
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassAuthentication:
+		return "authentication"
+	case ErrorClassSession:
+		return "session"
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassProtocol:
+		return "protocol"
+	case ErrorClassUnsupportedMethod:
+		return "unsupported_method"
+	case ErrorClassInvalidRequest:
+		return "invalid_request"
+	case ErrorClassDevice:
+		return "device"
+	default:
+		return "unknown"
+	}
+}
+
+// DeviceError is an error code returned by the device for a method.
+type DeviceError struct {
+	Method string
+	Code   ErrorCode
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("%s failed with error code %d (%s)", e.Method, e.Code, e.Code)
+}
+
+// Is matches other device errors with the same code and the sentinel
+// of the error class.
+func (e *DeviceError) Is(target error) bool {
+	if other, ok := target.(*DeviceError); ok {
+		return e.Code == other.Code && (other.Method == "" || e.Method == other.Method)
+	}
+
+	sentinel := e.Code.Class().sentinel()
+
+	return sentinel != nil && target == sentinel
+}
+
+// StatusError is an unexpected HTTP status returned by the device.
+type StatusError struct {
+	Operation  string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed with status code %d", e.Operation, e.StatusCode)
+}
+
+func (e *StatusError) Class() ErrorClass {
+	switch {
+	case e.StatusCode == 404:
+		return ErrorClassProtocol
+	case e.StatusCode == 401 || e.StatusCode == 403:
+		return ErrorClassSession
+	case e.StatusCode >= 500:
+		return ErrorClassTransient
+	default:
+		return ErrorClassUnknown
+	}
+}
+
+func (e *StatusError) Is(target error) bool {
+	sentinel := e.Class().sentinel()
+
+	return sentinel != nil && target == sentinel
+}
+
+// PinError is a device certificate that doesn't match the one pinned for
+// the device, which may be replaced or impersonated.
+type PinError struct {
+	Address     string
+	Pinned      string
+	Fingerprint string
+}
+
+func (e *PinError) Error() string {
+	return fmt.Sprintf("certificate of %s has fingerprint %s, expected the pinned %s", e.Address, e.Fingerprint, e.Pinned)
+}
+
+func (e *PinError) Is(target error) bool {
+	return target == ErrAuthentication
+}
+
+// DecodeStage is the step at which data from the device failed to decode.
+type DecodeStage string
+
+const (
+	DecodeStageBase64 DecodeStage = "base64"
+	DecodeStageRSA    DecodeStage = "rsa"
+	DecodeStageAES    DecodeStage = "aes"
+	DecodeStagePKCS7  DecodeStage = "pkcs7"
+	DecodeStageKlap   DecodeStage = "klap"
+	DecodeStageJSON   DecodeStage = "json"
+
+	// DecodeStageResult is a response that decoded, but doesn't fit the
+	// result expected by the caller
+	DecodeStageResult DecodeStage = "result"
+)
+
+// DecodeError is malformed data returned by the device.
+type DecodeError struct {
+	Operation string
+	Stage     DecodeStage
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: invalid %s data: %v", e.Operation, e.Stage, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Class treats undecryptable data as a broken session, and undecodable
+// JSON, usually a truncated response, as transient. A result of another
+// shape is what the device answers, neither a new session nor another
+// attempt changes it.
+func (e *DecodeError) Class() ErrorClass {
+	switch e.Stage {
+	case DecodeStageJSON:
+		return ErrorClassTransient
+	case DecodeStageResult:
+		return ErrorClassDevice
+	default:
+		return ErrorClassSession
+	}
+}
+
+func (e *DecodeError) Is(target error) bool {
+	sentinel := e.Class().sentinel()
+
+	return sentinel != nil && target == sentinel
+}
+
+// Classify returns the class of the error, looking through wrapped
+// device and status errors, and treating network failures as transient.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ErrorClassUnknown
+	}
+
+	for _, s := range classSentinels {
+		if errors.Is(err, s.sentinel) {
+			return s.class
+		}
+	}
+
+	if isContextError(err) {
+		return ErrorClassTransient
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrorClassTransient
+	}
+
+	return ErrorClassUnknown
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// fuzzSession returns a session with a fixed key and IV, so the fuzzer
+// can find valid ciphertexts.
+func fuzzSession(t testing.TB) *AesEncryptedSession {
+	session, err := newAesEncryptedSessionFromKey([]byte("0123456789abcdef0123456789abcdef"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session
+}
+
+func FuzzPkcs7Unpad(f *testing.F) {
+	f.Add([]byte("0123456789abcdef"), 16)
+	f.Add(bytes.Repeat([]byte{16}, 16), 16)
+	f.Add([]byte("abc\x01"), 4)
+	f.Add([]byte{}, 16)
+	f.Add([]byte{0}, 1)
+
+	f.Fuzz(func(t *testing.T, data []byte, blocksize int) {
+		unpadded, err := pkcs7Unpad(data, blocksize)
+
+		if err != nil {
+			return
+		}
+
+		if padding := len(data) - len(unpadded); padding < 1 || padding > blocksize {
+			t.Fatalf("removed %d bytes of padding with block size %d", padding, blocksize)
+		}
+
+		// only valid padding is removed, padding again restores the input
+		if len(unpadded) > 0 {
+			padded, err := pkcs7Pad(unpadded, blocksize)
+
+			if err != nil || !bytes.Equal(padded, data) {
+				t.Fatalf("padding %x again gave %x, expected %x", unpadded, padded, data)
+			}
+		}
+	})
+}
+
+func FuzzAesDecrypt(f *testing.F) {
+	session := fuzzSession(f)
+
+	encrypted, _ := session.Encrypt([]byte(`{"error_code":0}`))
+
+	f.Add(encrypted)
+	f.Add(encrypted[:15])
+	f.Add([]byte{})
+	f.Add(make([]byte, 32))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decrypted, err := session.Decrypt(data)
+
+		if err != nil {
+			var decodeErr *DecodeError
+
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("got %T, expected a decode error: %v", err, err)
+			}
+
+			return
+		}
+
+		if len(data)%16 != 0 {
+			t.Fatalf("decrypted %d bytes, not a multiple of the block size", len(data))
+		}
+
+		// CBC with a fixed IV is deterministic, encrypting again restores
+		// the input
+		if len(decrypted) > 0 {
+			if encrypted, _ := session.Encrypt(decrypted); !bytes.Equal(encrypted, data) {
+				t.Fatalf("encrypting %x again gave %x, expected %x", decrypted, encrypted, data)
+			}
+		}
+	})
+}
+
+func FuzzPassthroughResponse(f *testing.F) {
+	session := fuzzSession(f)
+
+	encrypted, _ := session.Encrypt([]byte(`{"error_code":0,"result":{}}`))
+	valid, _ := json.Marshal(&AesPassthroughResponse{
+		Result: AesPassthroughResponseResult{
+			Response: base64.StdEncoding.EncodeToString(encrypted),
+		},
+	})
+
+	f.Add(valid)
+	f.Add([]byte(`{"error_code":-1010}`))
+	f.Add([]byte(`{"error_code":0,"result":{"response":"not base64"}}`))
+	f.Add([]byte(`{"error_code":0,"result":{"response":"AAAA"}}`))
+	f.Add([]byte(`{`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		decrypted, err := decodePassthroughResponse(session, body)
+
+		if err == nil {
+			return
+		}
+
+		if decrypted != nil {
+			t.Fatalf("got %q along with error %v", decrypted, err)
+		}
+
+		// every failure is typed, so retries and metrics can act on it
+		var decodeErr *DecodeError
+		var deviceErr *DeviceError
+
+		if !errors.As(err, &decodeErr) && !errors.As(err, &deviceErr) {
+			t.Fatalf("got untyped error %T: %v", err, err)
+		}
+	})
+}
+
+func FuzzLegacyFrame(f *testing.F) {
+	frame := func(payload string) []byte {
+		encrypted := XorEncrypt([]byte(payload))
+
+		return binary.BigEndian.AppendUint32(nil, uint32(len(encrypted)))
+	}
+
+	f.Add(append(frame(`{"system":{}}`), XorEncrypt([]byte(`{"system":{}}`))...))
+	f.Add(frame(`{"system":{}}`))
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decrypted, size, err := readLegacyFrame(bytes.NewReader(data))
+
+		if err != nil {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint32(data))
+
+		if len(decrypted) != length || size != 4+length || size > len(data) {
+			t.Fatalf("got %d bytes in a frame of %d, expected %d of %d", len(decrypted), size, length, len(data))
+		}
+
+		if !bytes.Equal(XorEncrypt(decrypted), data[4:size]) {
+			t.Fatalf("decrypted %x does not encrypt back to the frame", decrypted)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dehydr8/kasa-go/model"
+)
+
+// NewHTTPClient builds the HTTP client for a transport, a nil options
+// returns a client with the defaults of net/http.
+func NewHTTPClient(options *model.HTTPOptions) (*http.Client, error) {
+	if options == nil {
+		return &http.Client{}, nil
+	}
+
+	// same as http.DefaultTransport
+	dialer, err := newDialer(options, 30*time.Second)
+
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.DialContext = dialer.DialContext
+	transport.DisableKeepAlives = options.DisableKeepAlives
+
+	if options.ResponseTimeout > 0 {
+		transport.ResponseHeaderTimeout = options.ResponseTimeout
+	}
+
+	if options.IdleTimeout > 0 {
+		transport.IdleConnTimeout = options.IdleTimeout
+	}
+
+	if options.MaxIdleConns > 0 {
+		// every device has its own client, so both limits are the same
+		transport.MaxIdleConns = options.MaxIdleConns
+		transport.MaxIdleConnsPerHost = options.MaxIdleConns
+	}
+
+	if options.Proxy != "" {
+		proxy, err := parseProxy(options.Proxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// parseProxy parses the URL of an HTTP, HTTPS or SOCKS5 proxy.
+func parseProxy(raw string) (*url.URL, error) {
+	proxy, err := url.Parse(raw)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %s: no host", raw)
+	}
+
+	return proxy, nil
+}
+
+// newDialer returns a dialer honouring the connect timeout, keep-alive
+// and source address of the options.
+func newDialer(options *model.HTTPOptions, timeout time.Duration) (*net.Dialer, error) {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if options == nil {
+		return dialer, nil
+	}
+
+	if options.ConnectTimeout > 0 {
+		dialer.Timeout = options.ConnectTimeout
+	}
+
+	if options.KeepAlive != 0 {
+		dialer.KeepAlive = options.KeepAlive
+	}
+
+	if options.SourceAddress != "" {
+		ip, err := sourceIP(options.SourceAddress)
+
+		if err != nil {
+			return nil, err
+		}
+
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	return dialer, nil
+}
+
+// sourceIP resolves the source address, either an IP or the name of an
+// interface whose first IPv4 address, or first address, is used.
+func sourceIP(address string) (net.IP, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(address)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid source address %s: %w", address, err)
+	}
+
+	addrs, err := iface.Addrs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+
+	for _, addr := range addrs {
+		if prefix, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, prefix.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+
+	if len(ips) > 0 {
+		return ips[0], nil
+	}
+
+	return nil, fmt.Errorf("interface %s has no addresses", address)
+}
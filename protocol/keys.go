@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/dehydr8/kasa-go/logger"
+)
+
+// KeySizes are the RSA key sizes accepted by device firmware, older
+// firmware only handles 1024-bit keys.
+var KeySizes = []int{1024, 2048}
+
+// GenerateKey generates an RSA key of one of the supported sizes.
+func GenerateKey(bits int) (*rsa.PrivateKey, error) {
+	if !validKeySize(bits) {
+		return nil, fmt.Errorf("unsupported key size %d, expected one of %v", bits, KeySizes)
+	}
+
+	return rsa.GenerateKey(rand.Reader, bits)
+}
+
+// LoadOrGenerateKey loads the PEM encoded RSA key at path, generating
+// and saving a key of the given size if the file does not exist.
+func LoadOrGenerateKey(path string, bits int) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+
+	if err == nil {
+		key, err := DecodeKey(data)
+
+		if err != nil {
+			return nil, fmt.Errorf("key file %s: %w", path, err)
+		}
+
+		if !validKeySize(key.N.BitLen()) {
+			return nil, fmt.Errorf("key file %s: unsupported key size %d, expected one of %v", path, key.N.BitLen(), KeySizes)
+		}
+
+		return key, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	logger.Info("msg", "Generating RSA key", "path", path, "bits", bits)
+
+	key, err := GenerateKey(bits)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(path, EncodeKey(key), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// EncodeKey encodes the key as a PKCS #1 PEM block.
+func EncodeKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+// DecodeKey decodes an RSA key from a PKCS #1 or PKCS #8 PEM block.
+func DecodeKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := parsed.(*rsa.PrivateKey)
+
+		if !ok {
+			return nil, fmt.Errorf("not an RSA key")
+		}
+
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %s", block.Type)
+	}
+}
+
+func validKeySize(bits int) bool {
+	for _, size := range KeySizes {
+		if size == bits {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,126 @@
+package protocol_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+func TestLoadOrGenerateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+
+	generated, err := protocol.LoadOrGenerateKey(path, 1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bits := generated.N.BitLen(); bits != 1024 {
+		t.Errorf("got a %d-bit key, expected 1024", bits)
+	}
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatalf("key not saved: %v", err)
+	}
+
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("got permissions %o, expected 0600", perm)
+	}
+
+	// the size only applies to generated keys
+	loaded, err := protocol.LoadOrGenerateKey(path, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !generated.Equal(loaded) {
+		t.Errorf("got a different key loading the saved one")
+	}
+}
+
+func TestLoadOrGenerateKeyInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pem")
+
+	if _, err := protocol.LoadOrGenerateKey(path, 512); err == nil {
+		t.Errorf("expected a 512-bit key not to be generated")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("got %v, expected no key to be saved", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := protocol.LoadOrGenerateKey(path, 1024); err == nil {
+		t.Errorf("expected an invalid key file to fail instead of being replaced")
+	}
+}
+
+func TestDecodeKey(t *testing.T) {
+	key := testKey(t)
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecPkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{"pkcs1", protocol.EncodeKey(key), true},
+		{"pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), true},
+		{"not rsa", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecPkcs8}), false},
+		{"unexpected block", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pkcs8}), false},
+		{"corrupt", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte("corrupt")}), false},
+		{"not pem", []byte("not a key"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := protocol.DecodeKey(tt.data)
+
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("expected the key to be rejected")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !key.Equal(decoded) {
+				t.Errorf("got a different key after decoding")
+			}
+		})
+	}
+}
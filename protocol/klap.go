@@ -0,0 +1,502 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/model"
+)
+
+var _ Protocol = (*KlapTransport)(nil)
+
+const (
+	klapSessionCookie = "TP_SESSIONID"
+	klapTimeoutCookie = "TIMEOUT"
+
+	// refresh the session a bit before the device expires it
+	klapSessionExpiryBuffer = 20 * time.Minute
+)
+
+type KlapTransport struct {
+	config *model.DeviceConfig
+	url    string
+
+	session *KlapEncryptedSession
+
+	handshakeDone bool
+	sessionExpiry time.Time
+	cookies       map[string]string
+
+	httpClient *http.Client
+
+	closed   atomic.Bool
+	sendLock sendLock
+}
+
+func NewKlapTransport(config *model.DeviceConfig) (*KlapTransport, error) {
+	target, err := targetOf(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := NewHTTPClient(config.HTTP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &KlapTransport{
+		config: config,
+		url:    target.URL("/app", ""),
+
+		handshakeDone: false,
+
+		httpClient:    httpClient,
+		cookies:       make(map[string]string),
+		sessionExpiry: time.Now(),
+		sendLock:      newSendLock(),
+	}, nil
+}
+
+func (t *KlapTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *KlapTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if err := t.sendLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer t.sendLock.Unlock()
+
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	return withRetry(ctx, t.config.Retry, t.config.Address, t.resetSession, func() error {
+		return t.send(ctx, request, response)
+	})
+}
+
+func (t *KlapTransport) send(ctx context.Context, request, response interface{}) error {
+	if !t.handshakeDone || t.handshakeExpired() {
+		err := t.handshake(ctx)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err := t.request(ctx, request, response)
+
+	// only a session error says the session is gone, whether other errors
+	// need a new session is up to the retry policy
+	if err != nil && ctx.Err() == nil && Classify(err) == ErrorClassSession {
+		t.resetSession()
+	}
+
+	return err
+}
+
+func (t *KlapTransport) resetSession() {
+	t.session = nil
+	t.sessionExpiry = time.Now()
+	t.handshakeDone = false
+	t.cookies = make(map[string]string)
+}
+
+func (t *KlapTransport) Close() error {
+	t.closed.Store(true)
+	t.httpClient.CloseIdleConnections()
+
+	return nil
+}
+
+func (t *KlapTransport) handshakeExpired() bool {
+	return time.Now().After(t.sessionExpiry)
+}
+
+func (t *KlapTransport) handshake(ctx context.Context) error {
+	return observeHandshake(t.config, TransportKlap, func() error {
+		return t.performHandshake(ctx)
+	})
+}
+
+func (t *KlapTransport) performHandshake(ctx context.Context) error {
+
+	logger.Debug("msg", "performing klap handshake", "target", t.config.Address)
+
+	t.cookies = make(map[string]string)
+
+	localSeed := make([]byte, 16)
+
+	if _, err := rand.Read(localSeed); err != nil {
+		return err
+	}
+
+	res, body, err := t.post(ctx, "/handshake1", localSeed)
+
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != 200 {
+		return &StatusError{Operation: "handshake1", StatusCode: res.StatusCode}
+	}
+
+	if len(body) != 48 {
+		return &DecodeError{Operation: "handshake1", Stage: DecodeStageKlap, Err: fmt.Errorf("%d bytes, expected 48", len(body))}
+	}
+
+	remoteSeed := body[:16]
+	serverHash := body[16:]
+
+	authHash, v2, err := t.matchAuthHash(localSeed, remoteSeed, serverHash)
+
+	if err != nil {
+		return err
+	}
+
+	expiry := 86400 * time.Second
+
+	for _, c := range res.Cookies() {
+		switch c.Name {
+		case klapSessionCookie:
+			t.cookies[c.Name] = c.Value
+		case klapTimeoutCookie:
+			if seconds, err := strconv.Atoi(c.Value); err == nil {
+				expiry = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	var payload []byte
+
+	if v2 {
+		payload = sha256Sum(remoteSeed, localSeed, authHash)
+	} else {
+		payload = sha256Sum(remoteSeed, authHash)
+	}
+
+	res, _, err = t.post(ctx, "/handshake2", payload)
+
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != 200 {
+		return &StatusError{Operation: "handshake2", StatusCode: res.StatusCode}
+	}
+
+	t.session, err = NewKlapEncryptedSession(localSeed, remoteSeed, authHash)
+
+	if err != nil {
+		return err
+	}
+
+	if expiry > klapSessionExpiryBuffer {
+		expiry -= klapSessionExpiryBuffer
+	}
+
+	t.sessionExpiry = time.Now().Add(expiry)
+	t.handshakeDone = true
+
+	return nil
+}
+
+// matchAuthHash checks the hash returned by the device against the
+// hashes we can derive from our credentials, trying the v2 (sha256)
+// scheme first and falling back to the older v1 (md5) one, and then the
+// default credentials if enabled.
+func (t *KlapTransport) matchAuthHash(localSeed, remoteSeed, serverHash []byte) ([]byte, bool, error) {
+	credentials := []*model.Credentials{t.config.Credentials}
+
+	if t.config.TryDefaultCredentials {
+		for i := range model.DefaultCredentials {
+			credentials = append(credentials, &model.DefaultCredentials[i])
+		}
+	}
+
+	event := model.LoginEvent{
+		Address:   t.config.Address,
+		Transport: TransportKlap,
+	}
+
+	for _, creds := range credentials {
+		authHash, v2, ok := matchKlapAuthHash(creds, localSeed, remoteSeed, serverHash)
+
+		if !ok {
+			continue
+		}
+
+		if creds != t.config.Credentials {
+			logger.Warn("msg", "device accepted default credentials", "target", t.config.Address, "username", creds.Username)
+		}
+
+		event.LoginVersion = 1
+		if v2 {
+			event.LoginVersion = 2
+		}
+
+		event.DefaultCredentials = creds != t.config.Credentials
+
+		observerFor(t.config).LoginFinished(event)
+
+		return authHash, v2, nil
+	}
+
+	event.Err = fmt.Errorf("handshake1 hash mismatch, check credentials: %w", ErrAuthentication)
+
+	observerFor(t.config).LoginFinished(event)
+
+	return nil, false, event.Err
+}
+
+func matchKlapAuthHash(creds *model.Credentials, localSeed, remoteSeed, serverHash []byte) ([]byte, bool, bool) {
+	if authHash, ok := klapAuthHashV2(creds); ok {
+		if bytes.Equal(sha256Sum(localSeed, remoteSeed, authHash), serverHash) {
+			return authHash, true, true
+		}
+	}
+
+	if authHash, ok := klapAuthHashV1(creds); ok {
+		if bytes.Equal(sha256Sum(localSeed, authHash), serverHash) {
+			return authHash, false, true
+		}
+	}
+
+	return nil, false, false
+}
+
+func klapAuthHashV2(creds *model.Credentials) ([]byte, bool) {
+	user := sha1.Sum([]byte(creds.Username))
+
+	var pass []byte
+
+	if creds.HashedPassword != "" {
+		decoded, err := hex.DecodeString(creds.HashedPassword)
+
+		if err != nil {
+			return nil, false
+		}
+
+		pass = decoded
+	} else {
+		sum := sha1.Sum([]byte(creds.Password))
+		pass = sum[:]
+	}
+
+	return sha256Sum(user[:], pass), true
+}
+
+func klapAuthHashV1(creds *model.Credentials) ([]byte, bool) {
+	// the v1 scheme needs the plain password
+	if creds.Password == "" && creds.HashedPassword != "" {
+		return nil, false
+	}
+
+	return Md5sum(append(Md5sum([]byte(creds.Username)), Md5sum([]byte(creds.Password))...)), true
+}
+
+func (t *KlapTransport) request(ctx context.Context, request interface{}, response interface{}) error {
+	marshalledRequest, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	event := &model.RequestEvent{
+		Address:   t.config.Address,
+		Transport: TransportKlap,
+		Method:    requestMethod(marshalledRequest),
+	}
+
+	start := time.Now()
+
+	decrypted, err := t.exchange(ctx, marshalledRequest, event)
+
+	if err == nil {
+		if err = json.Unmarshal(decrypted, response); err != nil {
+			err = &DecodeError{Operation: "request", Stage: DecodeStageResult, Err: err}
+		}
+	}
+
+	finishRequest(t.config, event, start, decrypted, err)
+
+	return err
+}
+
+// exchange sends the encrypted request and returns the decrypted
+// response.
+func (t *KlapTransport) exchange(ctx context.Context, marshalledRequest []byte, event *model.RequestEvent) ([]byte, error) {
+	if t.session == nil {
+		return nil, fmt.Errorf("session not initialized")
+	}
+
+	logger.Debug("msg", "sending request", "request", string(marshalledRequest))
+
+	payload, seq := t.session.Encrypt(marshalledRequest)
+
+	event.RequestBytes = len(payload)
+
+	res, body, err := t.post(ctx, fmt.Sprintf("/request?seq=%d", seq), payload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	event.ResponseBytes = len(body)
+
+	if res.StatusCode != 200 {
+		return nil, &StatusError{Operation: "request", StatusCode: res.StatusCode}
+	}
+
+	decrypted, err := t.session.Decrypt(body, seq)
+
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debug("msg", "decrypted response", "response", string(decrypted))
+
+	return decrypted, nil
+}
+
+func (t *KlapTransport) post(ctx context.Context, path string, payload []byte) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url+path, bytes.NewBuffer(payload))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	for k, v := range t.cookies {
+		req.AddCookie(&http.Cookie{
+			Name:  k,
+			Value: v,
+		})
+	}
+
+	res, err := t.httpClient.Do(req)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return res, body, nil
+}
+
+type KlapEncryptedSession struct {
+	block cipher.Block
+
+	iv        []byte
+	signature []byte
+	seq       int32
+
+	lock sync.Mutex
+}
+
+func NewKlapEncryptedSession(localSeed, remoteSeed, authHash []byte) (*KlapEncryptedSession, error) {
+	localHash := make([]byte, 0, len(localSeed)+len(remoteSeed)+len(authHash))
+	localHash = append(localHash, localSeed...)
+	localHash = append(localHash, remoteSeed...)
+	localHash = append(localHash, authHash...)
+
+	block, err := aes.NewCipher(sha256Sum([]byte("lsk"), localHash)[:16])
+
+	if err != nil {
+		return nil, err
+	}
+
+	fullIv := sha256Sum([]byte("iv"), localHash)
+
+	return &KlapEncryptedSession{
+		block:     block,
+		iv:        fullIv[:12],
+		seq:       int32(binary.BigEndian.Uint32(fullIv[28:])),
+		signature: sha256Sum([]byte("ldk"), localHash)[:28],
+	}, nil
+}
+
+// Encrypt bumps the sequence number and returns the signed ciphertext
+// along with the sequence it was encrypted for.
+func (s *KlapEncryptedSession) Encrypt(data []byte) ([]byte, int32) {
+	s.lock.Lock()
+	s.seq++
+	seq := s.seq
+	s.lock.Unlock()
+
+	padded, _ := pkcs7Pad(data, s.block.BlockSize())
+
+	ciphertext := make([]byte, len(padded))
+
+	encryptor := cipher.NewCBCEncrypter(s.block, s.ivForSeq(seq))
+
+	encryptor.CryptBlocks(ciphertext, padded)
+
+	seqBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(seqBytes, uint32(seq))
+
+	return append(sha256Sum(s.signature, seqBytes, ciphertext), ciphertext...), seq
+}
+
+func (s *KlapEncryptedSession) Decrypt(data []byte, seq int32) ([]byte, error) {
+	if len(data) <= sha256.Size || (len(data)-sha256.Size)%s.block.BlockSize() != 0 {
+		return nil, &DecodeError{Operation: "klap decrypt", Stage: DecodeStageAES, Err: fmt.Errorf("invalid length %d", len(data))}
+	}
+
+	ciphertext := data[sha256.Size:]
+	plaintext := make([]byte, len(ciphertext))
+
+	decryptor := cipher.NewCBCDecrypter(s.block, s.ivForSeq(seq))
+
+	decryptor.CryptBlocks(plaintext, ciphertext)
+
+	unpadded, err := pkcs7Unpad(plaintext, s.block.BlockSize())
+
+	if err != nil {
+		return nil, &DecodeError{Operation: "klap decrypt", Stage: DecodeStagePKCS7, Err: err}
+	}
+
+	return unpadded, nil
+}
+
+func (s *KlapEncryptedSession) ivForSeq(seq int32) []byte {
+	iv := make([]byte, 16)
+	copy(iv, s.iv)
+	binary.BigEndian.PutUint32(iv[12:], uint32(seq))
+	return iv
+}
+
+func sha256Sum(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
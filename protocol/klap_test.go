@@ -0,0 +1,128 @@
+package protocol_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+func TestKlapHandshakeLength(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 40))
+	}))
+	t.Cleanup(server.Close)
+
+	transport, err := protocol.NewKlapTransport(&model.DeviceConfig{
+		Address:     strings.TrimPrefix(server.URL, "http://"),
+		Credentials: &credentials,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = getDeviceInfo(t, transport)
+
+	var decodeErr *protocol.DecodeError
+
+	if !errors.As(err, &decodeErr) || decodeErr.Stage != protocol.DecodeStageKlap {
+		t.Fatalf("got %v, expected a klap decode error", err)
+	}
+
+	if class := protocol.Classify(err); class != protocol.ErrorClassSession {
+		t.Errorf("got class %s, expected %s", class, protocol.ErrorClassSession)
+	}
+}
+
+func TestKlapLoginVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+	}{
+		{"v2", 2},
+		{"v1", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := devicetest.NewKlapDevice(credentials)
+			device.LoginVersion = tt.version
+			t.Cleanup(device.Close)
+
+			transport, err := protocol.NewKlapTransport(device.Config())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 3; i++ {
+				if _, err := getDeviceInfo(t, transport); err != nil {
+					t.Fatalf("get_device_info failed: %v", err)
+				}
+			}
+
+			// the session is reused for later requests
+			if calls := device.Calls("handshake2"); calls != 1 {
+				t.Errorf("got %d handshakes, expected 1", calls)
+			}
+		})
+	}
+}
+
+func TestKlapInvalidCredentials(t *testing.T) {
+	device := devicetest.NewKlapDevice(credentials)
+	t.Cleanup(device.Close)
+
+	config := device.Config()
+	config.Credentials = &model.Credentials{Username: credentials.Username, Password: "wrong"}
+
+	transport, err := protocol.NewKlapTransport(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := getDeviceInfo(t, transport); !errors.Is(err, protocol.ErrAuthentication) {
+		t.Fatalf("got %v, expected an authentication error", err)
+	}
+
+	if calls := device.Calls("handshake2"); calls != 0 {
+		t.Errorf("got %d handshake2 requests after a hash mismatch, expected none", calls)
+	}
+}
+
+// TestKlapTransientRetried expects a transient error to be retried on the
+// current session, as the default policy says.
+func TestKlapTransientRetried(t *testing.T) {
+	device := devicetest.NewKlapDevice(credentials)
+	t.Cleanup(device.Close)
+
+	config := device.Config()
+	config.Retry = &model.DefaultRetryPolicy
+
+	transport, err := protocol.NewKlapTransport(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	device.InjectFault(devicetest.Fault{Method: "request", StatusCode: 500, Times: 1})
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("transient error was not retried: %v", err)
+	}
+
+	if calls := device.Calls("handshake1"); calls != 1 {
+		t.Errorf("got %d handshakes, expected 1", calls)
+	}
+}
@@ -0,0 +1,630 @@
+package protocol
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/model"
+)
+
+var _ Protocol = (*LegacyTransport)(nil)
+
+const (
+	LegacyPort = 9999
+
+	legacyInitializationVector = 171
+	legacyTimeout              = 10 * time.Second
+	legacyMaxResponseSize      = 1 << 20
+)
+
+// LegacyTransport talks the XOR "autokey" protocol spoken by older Kasa
+// devices (HS1xx, KP1xx, HS300) over TCP. SMART style requests such as
+// get_device_info are translated to their legacy counterparts and the
+// responses are mapped back, so callers can use the same API for both.
+// control_child requests address the outlets of strips (KP303, HS300)
+// with the context of the query, as legacy devices expect.
+type LegacyTransport struct {
+	config  *model.DeviceConfig
+	address string
+
+	// connects directly, or through the SOCKS5 proxy of the HTTP options
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
+	closed   atomic.Bool
+	sendLock sendLock
+}
+
+type LegacySysInfo struct {
+	ErrorCode       int    `json:"err_code"`
+	SoftwareVersion string `json:"sw_ver"`
+	HardwareVersion string `json:"hw_ver"`
+	Type            string `json:"type"`
+	MicType         string `json:"mic_type"`
+	Model           string `json:"model"`
+	MAC             string `json:"mac"`
+	MicMAC          string `json:"mic_mac"`
+	DeviceId        string `json:"deviceId"`
+	Alias           string `json:"alias"`
+	RelayState      int    `json:"relay_state"`
+	OnTime          int    `json:"on_time"`
+	Rssi            int    `json:"rssi"`
+
+	// the outlets of strips
+	Children []LegacyChildInfo `json:"children"`
+}
+
+type LegacyChildInfo struct {
+	Id     string `json:"id"`
+	Alias  string `json:"alias"`
+	State  int    `json:"state"`
+	OnTime int    `json:"on_time"`
+}
+
+type LegacySysInfoResponse struct {
+	System struct {
+		SysInfo LegacySysInfo `json:"get_sysinfo"`
+	} `json:"system"`
+}
+
+type LegacyRealtime struct {
+	ErrorCode int `json:"err_code"`
+
+	// hardware v2+ reports milliwatts, v1 reports watts
+	PowerMw *float64 `json:"power_mw"`
+	Power   *float64 `json:"power"`
+}
+
+func NewLegacyTransport(config *model.DeviceConfig) (*LegacyTransport, error) {
+	target, err := targetOf(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dialer, err := newDialer(config.HTTP, legacyTimeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dial := dialer.DialContext
+
+	if config.HTTP != nil && config.HTTP.Proxy != "" {
+		proxy, err := parseProxy(config.HTTP.Proxy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// the legacy protocol is not HTTP, only a SOCKS5 proxy can relay it
+		if proxy.Scheme != "socks5" {
+			return nil, fmt.Errorf("legacy transport can't use %s proxy %s, only socks5 proxies", proxy.Scheme, proxy.Host)
+		}
+
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialSocks5(ctx, dialer, proxy, address)
+		}
+	}
+
+	return &LegacyTransport{
+		config:      config,
+		address:     target.HostPort(LegacyPort),
+		dialContext: dial,
+		sendLock:    newSendLock(),
+	}, nil
+}
+
+func (t *LegacyTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *LegacyTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if err := t.sendLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer t.sendLock.Unlock()
+
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	marshalled, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	var req legacyRequest
+
+	if err := json.Unmarshal(marshalled, &req); err != nil {
+		return err
+	}
+
+	switch req.Method {
+	case "":
+		// already a legacy request, pass it through untouched
+		return t.query(ctx, "", request, response)
+	case "control_child":
+		var params legacyChildParams
+
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return fmt.Errorf("invalid control_child params: %w", err)
+		}
+
+		responseData, err := t.dispatch(ctx, req.Method, params.RequestData, params.DeviceId)
+
+		if err != nil {
+			return err
+		}
+
+		return remarshal(map[string]interface{}{
+			"error_code": 0,
+			"result": map[string]interface{}{
+				"responseData": responseData,
+			},
+		}, response)
+	case "multipleRequest":
+		res, err := t.dispatch(ctx, req.Method, req, "")
+
+		if err != nil {
+			return err
+		}
+
+		return remarshal(res, response)
+	default:
+		responses, err := t.translate(ctx, req.Method, []legacyRequest{{Method: req.Method, Params: req.Params}}, "")
+
+		if err != nil {
+			return err
+		}
+
+		if code := responses[0].ErrorCode; code == int(ErrorCodeUnknownMethod) {
+			return &DeviceError{Method: req.Method, Code: ErrorCodeUnknownMethod}
+		}
+
+		return remarshal(responses[0], response)
+	}
+}
+
+func (t *LegacyTransport) Close() error {
+	t.closed.Store(true)
+
+	return nil
+}
+
+type legacyRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type legacyMultipleParams struct {
+	Requests []legacyRequest `json:"requests"`
+}
+
+type legacyChildParams struct {
+	DeviceId    string        `json:"device_id"`
+	RequestData legacyRequest `json:"requestData"`
+}
+
+type legacyMethodResponse struct {
+	Method    string                 `json:"method"`
+	ErrorCode int                    `json:"error_code"`
+	Result    map[string]interface{} `json:"result"`
+}
+
+// legacyMethod maps a SMART method to the legacy module and method,
+// the SMART params to the legacy ones, and the legacy result back to the
+// SMART one, for the device or the child with the given id. Methods
+// without mapParams send empty params.
+type legacyMethod struct {
+	module    string
+	method    string
+	mapResult func(data json.RawMessage, childId string) (int, map[string]interface{}, error)
+	mapParams func(params json.RawMessage) (interface{}, error)
+}
+
+var legacyMethods = map[string]legacyMethod{
+	"get_device_info":  {"system", "get_sysinfo", mapLegacySysInfo, nil},
+	"get_energy_usage": {"emeter", "get_realtime", mapLegacyRealtime, nil},
+	"set_device_info":  {"system", "set_relay_state", mapLegacyErrCode("set_relay_state"), mapLegacyRelayState},
+}
+
+// dispatch translates a single request or a multipleRequest for the
+// device, or for its child with the given id, and returns the SMART
+// response.
+func (t *LegacyTransport) dispatch(ctx context.Context, method string, req legacyRequest, childId string) (interface{}, error) {
+	if req.Method != "multipleRequest" {
+		responses, err := t.translate(ctx, method, []legacyRequest{req}, childId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return responses[0], nil
+	}
+
+	var params legacyMultipleParams
+
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, err
+		}
+	}
+
+	responses, err := t.translate(ctx, method, params.Requests, childId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"error_code": 0,
+		"result": map[string]interface{}{
+			"responses": responses,
+		},
+	}, nil
+}
+
+// translate sends the legacy counterparts of the requests in a single
+// query, which legacy devices support by listing several modules. The
+// requests address the child with the given id if set.
+func (t *LegacyTransport) translate(ctx context.Context, method string, requests []legacyRequest, childId string) ([]legacyMethodResponse, error) {
+	query := make(map[string]map[string]interface{})
+
+	for _, req := range requests {
+		if m, ok := legacyMethods[req.Method]; ok {
+			var params interface{} = map[string]interface{}{}
+
+			if m.mapParams != nil {
+				var err error
+
+				if params, err = m.mapParams(req.Params); err != nil {
+					return nil, err
+				}
+			}
+
+			if query[m.module] == nil {
+				query[m.module] = make(map[string]interface{})
+			}
+			query[m.module][m.method] = params
+		}
+	}
+
+	var res map[string]map[string]json.RawMessage
+
+	if len(query) > 0 && childId != "" {
+		query["context"] = map[string]interface{}{
+			"child_ids": []string{childId},
+		}
+	}
+
+	if len(query) > 0 {
+		if err := t.query(ctx, method, query, &res); err != nil {
+			return nil, err
+		}
+	}
+
+	responses := make([]legacyMethodResponse, 0, len(requests))
+
+	for _, req := range requests {
+		response := legacyMethodResponse{Method: req.Method}
+
+		m, ok := legacyMethods[req.Method]
+
+		if !ok {
+			response.ErrorCode = int(ErrorCodeUnknownMethod)
+			responses = append(responses, response)
+			continue
+		}
+
+		data, ok := res[m.module][m.method]
+
+		if !ok {
+			// modules the device lacks report the error for the module
+			json.Unmarshal(res[m.module]["err_code"], &response.ErrorCode)
+
+			if response.ErrorCode == 0 {
+				response.ErrorCode = int(ErrorCodeCommonFailed)
+			}
+
+			responses = append(responses, response)
+			continue
+		}
+
+		code, result, err := m.mapResult(data, childId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		response.ErrorCode = code
+		response.Result = result
+
+		responses = append(responses, response)
+	}
+
+	return responses, nil
+}
+
+// mapLegacySysInfo maps the sysinfo of the device, or of the outlet with
+// the given id, which shares the details of the strip besides its state.
+func mapLegacySysInfo(data json.RawMessage, childId string) (int, map[string]interface{}, error) {
+	var info LegacySysInfo
+
+	if err := json.Unmarshal(data, &info); err != nil {
+		return 0, nil, &DecodeError{Operation: "get_sysinfo", Stage: DecodeStageResult, Err: err}
+	}
+
+	if info.ErrorCode != 0 {
+		return info.ErrorCode, nil, nil
+	}
+
+	deviceType := info.Type
+	if deviceType == "" {
+		deviceType = info.MicType
+	}
+
+	mac := info.MAC
+	if mac == "" {
+		mac = info.MicMAC
+	}
+
+	deviceId, alias, state, onTime := info.DeviceId, info.Alias, info.RelayState, info.OnTime
+
+	if childId != "" {
+		child := findLegacyChild(info.Children, childId)
+
+		if child == nil {
+			return int(ErrorCodeDevice), nil, nil
+		}
+
+		deviceId, alias, state, onTime = child.Id, child.Alias, child.State, child.OnTime
+	}
+
+	return 0, map[string]interface{}{
+		"device_id": deviceId,
+		"device_on": state == 1,
+		"model":     info.Model,
+		"type":      deviceType,
+		// smart devices report the nickname base64 encoded
+		"nickname": base64.StdEncoding.EncodeToString([]byte(alias)),
+		"rssi":     info.Rssi,
+		"on_time":  onTime,
+		"sw_ver":   info.SoftwareVersion,
+		"hw_ver":   info.HardwareVersion,
+		"mac":      mac,
+	}, nil
+}
+
+func findLegacyChild(children []LegacyChildInfo, childId string) *LegacyChildInfo {
+	for i := range children {
+		if children[i].Id == childId {
+			return &children[i]
+		}
+	}
+
+	return nil
+}
+
+// mapLegacyRealtime maps the realtime emeter readings, of the outlet if
+// the query addressed one.
+func mapLegacyRealtime(data json.RawMessage, _ string) (int, map[string]interface{}, error) {
+	var realtime LegacyRealtime
+
+	if err := json.Unmarshal(data, &realtime); err != nil {
+		return 0, nil, &DecodeError{Operation: "get_realtime", Stage: DecodeStageResult, Err: err}
+	}
+
+	if realtime.ErrorCode != 0 {
+		return realtime.ErrorCode, nil, nil
+	}
+
+	var power float64
+
+	if realtime.PowerMw != nil {
+		power = *realtime.PowerMw
+	} else if realtime.Power != nil {
+		power = *realtime.Power * 1000
+	}
+
+	return 0, map[string]interface{}{
+		"current_power": int(power),
+	}, nil
+}
+
+// mapLegacyRelayState maps the device_on param of set_device_info to the
+// relay state, the only part of the device info legacy devices can set.
+func mapLegacyRelayState(params json.RawMessage) (interface{}, error) {
+	var info struct {
+		DeviceOn *bool `json:"device_on"`
+	}
+
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &info); err != nil {
+			return nil, fmt.Errorf("invalid set_device_info params: %w", err)
+		}
+	}
+
+	if info.DeviceOn == nil {
+		return nil, fmt.Errorf("legacy devices only support setting device_on: %w", ErrInvalidRequest)
+	}
+
+	state := 0
+
+	if *info.DeviceOn {
+		state = 1
+	}
+
+	return map[string]interface{}{"state": state}, nil
+}
+
+// mapLegacyErrCode maps the result of legacy methods reporting nothing
+// but an error code.
+func mapLegacyErrCode(method string) func(data json.RawMessage, childId string) (int, map[string]interface{}, error) {
+	return func(data json.RawMessage, _ string) (int, map[string]interface{}, error) {
+		var result struct {
+			ErrorCode int `json:"err_code"`
+		}
+
+		if err := json.Unmarshal(data, &result); err != nil {
+			return 0, nil, &DecodeError{Operation: method, Stage: DecodeStageResult, Err: err}
+		}
+
+		return result.ErrorCode, map[string]interface{}{}, nil
+	}
+}
+
+func remarshal(value interface{}, response interface{}) error {
+	marshalled, err := json.Marshal(value)
+
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(marshalled, response); err != nil {
+		return &DecodeError{Operation: "legacy request", Stage: DecodeStageResult, Err: err}
+	}
+
+	return nil
+}
+
+// query sends a legacy request, method is the SMART method it was
+// translated from and only used to report the request.
+func (t *LegacyTransport) query(ctx context.Context, method string, request interface{}, response interface{}) error {
+	marshalled, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	event := &model.RequestEvent{
+		Address:   t.config.Address,
+		Transport: TransportLegacy,
+		Method:    method,
+	}
+
+	start := time.Now()
+
+	err = t.dial(ctx, marshalled, response, event)
+
+	finishRequest(t.config, event, start, nil, err)
+
+	return err
+}
+
+func (t *LegacyTransport) dial(ctx context.Context, marshalled []byte, response interface{}, event *model.RequestEvent) error {
+	logger.Debug("msg", "sending legacy request", "target", t.config.Address, "request", string(marshalled))
+
+	conn, err := t.dialContext(ctx, "tcp", t.address)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(legacyTimeout))
+
+	// unblock reads and writes as soon as the context is done, rather than
+	// using its deadline on the connection, which may expire before the
+	// context reports it
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	err = t.exchange(conn, marshalled, response, event)
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func (t *LegacyTransport) exchange(conn net.Conn, marshalled []byte, response interface{}, event *model.RequestEvent) error {
+	payload := make([]byte, 4, 4+len(marshalled))
+	binary.BigEndian.PutUint32(payload, uint32(len(marshalled)))
+	payload = append(payload, XorEncrypt(marshalled)...)
+
+	event.RequestBytes = len(payload)
+
+	if _, err := conn.Write(payload); err != nil {
+		return err
+	}
+
+	decrypted, size, err := readLegacyFrame(conn)
+
+	if err != nil {
+		return err
+	}
+
+	event.ResponseBytes = size
+
+	logger.Debug("msg", "received legacy response", "response", string(decrypted))
+
+	if err := json.Unmarshal(decrypted, response); err != nil {
+		return &DecodeError{Operation: "legacy query", Stage: DecodeStageJSON, Err: err}
+	}
+
+	return nil
+}
+
+// readLegacyFrame reads a length prefixed response and returns it
+// decrypted, along with the size of the frame.
+func readLegacyFrame(r io.Reader) ([]byte, int, error) {
+	header := make([]byte, 4)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+
+	if length > legacyMaxResponseSize {
+		return nil, 0, fmt.Errorf("legacy response too large (%d bytes)", length)
+	}
+
+	body := make([]byte, length)
+
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, err
+	}
+
+	return XorDecrypt(body), len(header) + len(body), nil
+}
+
+// XorEncrypt applies the legacy autokey cipher, where every byte is
+// XORed with the previous ciphertext byte.
+func XorEncrypt(data []byte) []byte {
+	key := byte(legacyInitializationVector)
+	encrypted := make([]byte, len(data))
+
+	for i, b := range data {
+		key = key ^ b
+		encrypted[i] = key
+	}
+
+	return encrypted
+}
+
+// XorDecrypt reverses XorEncrypt.
+func XorDecrypt(data []byte) []byte {
+	key := byte(legacyInitializationVector)
+	decrypted := make([]byte, len(data))
+
+	for i, b := range data {
+		decrypted[i] = key ^ b
+		key = b
+	}
+
+	return decrypted
+}
@@ -0,0 +1,294 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/model"
+)
+
+var _ Protocol = (*NegotiatingTransport)(nil)
+
+const (
+	TransportAes    = "aes"
+	TransportKlap   = "klap"
+	TransportLegacy = "legacy"
+	TransportCloud  = "cloud"
+	TransportTls    = "tls"
+)
+
+// Transports lists the transports in the order they are probed, the
+// cloud is never probed since it is addressed by device id.
+var Transports = []string{TransportAes, TransportKlap, TransportLegacy, TransportTls}
+
+// transportSchemes maps the transports to the target scheme implying
+// them, the legacy transport speaks neither.
+var transportSchemes = map[string]string{
+	TransportAes:  "http",
+	TransportKlap: "http",
+	TransportTls:  "https",
+}
+
+func NewTransport(name string, key *rsa.PrivateKey, config *model.DeviceConfig) (Protocol, error) {
+	switch name {
+	case TransportAes:
+		return NewAesTransport(key, config)
+	case TransportKlap:
+		return NewKlapTransport(config)
+	case TransportLegacy:
+		return NewLegacyTransport(config)
+	case TransportCloud:
+		return NewCloudTransport(config)
+	case TransportTls:
+		return NewTlsTransport(config)
+	default:
+		return nil, fmt.Errorf("unknown transport %s", name)
+	}
+}
+
+// Negotiator remembers which transport worked for every address, so
+// only the first request to a device pays for probing.
+type Negotiator struct {
+	key *rsa.PrivateKey
+
+	lock  sync.Mutex
+	known map[string]string
+}
+
+func NewNegotiator(key *rsa.PrivateKey) *Negotiator {
+	return &Negotiator{
+		key:   key,
+		known: make(map[string]string),
+	}
+}
+
+func (n *Negotiator) Transport(config *model.DeviceConfig) *NegotiatingTransport {
+	return &NegotiatingTransport{
+		negotiator: n,
+		config:     config,
+		sendLock:   newSendLock(),
+	}
+}
+
+func (n *Negotiator) lookup(address string) (string, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	name, ok := n.known[address]
+	return name, ok
+}
+
+func (n *Negotiator) remember(address, name string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.known[address] = name
+}
+
+func (n *Negotiator) forget(address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.known, address)
+}
+
+// candidates returns the transports to probe for the address, starting
+// with the one that worked last time.
+func (n *Negotiator) candidates(address string) []string {
+	known, ok := n.lookup(address)
+
+	if !ok {
+		return Transports
+	}
+
+	candidates := []string{known}
+
+	for _, name := range Transports {
+		if name != known {
+			candidates = append(candidates, name)
+		}
+	}
+
+	return candidates
+}
+
+// NegotiatingTransport picks the transport for a device on the first
+// request, using the request itself as the probe, and negotiates again
+// if the device later stops speaking it (e.g. after a firmware update).
+type NegotiatingTransport struct {
+	negotiator *Negotiator
+	config     *model.DeviceConfig
+
+	name      string
+	transport Protocol
+
+	closed   atomic.Bool
+	sendLock sendLock
+}
+
+func (t *NegotiatingTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *NegotiatingTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if err := t.sendLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer t.sendLock.Unlock()
+
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	if t.transport == nil {
+		return t.negotiate(ctx, request, response)
+	}
+
+	err := t.transport.SendContext(ctx, request, response)
+
+	// a refused connection is a device restarting, not a new protocol
+	if isUnsupported(err, false) {
+		logger.Debug("msg", "transport no longer supported, renegotiating", "target", t.config.Address, "transport", t.name, "err", err)
+
+		t.negotiator.forget(t.config.Address)
+		t.reset()
+
+		return t.negotiate(ctx, request, response)
+	}
+
+	return err
+}
+
+func (t *NegotiatingTransport) Close() error {
+	t.sendLock.Lock(context.Background())
+	defer t.sendLock.Unlock()
+
+	t.closed.Store(true)
+
+	return t.reset()
+}
+
+// Negotiated returns the name of the transport in use, or an empty
+// string if none has been negotiated yet.
+func (t *NegotiatingTransport) Negotiated() string {
+	t.sendLock.Lock(context.Background())
+	defer t.sendLock.Unlock()
+
+	return t.name
+}
+
+func (t *NegotiatingTransport) reset() error {
+	if t.transport == nil {
+		return nil
+	}
+
+	err := t.transport.Close()
+
+	t.transport = nil
+	t.name = ""
+
+	return err
+}
+
+func (t *NegotiatingTransport) negotiate(ctx context.Context, request, response interface{}) error {
+	var lastErr error
+
+	known, _ := t.negotiator.lookup(t.config.Address)
+
+	for _, name := range t.negotiator.candidates(t.config.Address) {
+		logger.Debug("msg", "probing transport", "target", t.config.Address, "transport", name)
+
+		config, err := t.probeConfig(name)
+
+		if err != nil {
+			return err
+		}
+
+		transport, err := NewTransport(name, t.negotiator.key, config)
+
+		// the options may rule out a transport, such as an HTTP proxy the
+		// legacy transport can't use, the others may still work
+		if err != nil {
+			logger.Debug("msg", "skipping transport", "target", t.config.Address, "transport", name, "err", err)
+
+			lastErr = err
+			continue
+		}
+
+		err = transport.SendContext(ctx, request, response)
+
+		if err == nil {
+			logger.Debug("msg", "negotiated transport", "target", t.config.Address, "transport", name)
+
+			// later requests are retried as configured, transports read
+			// the policy on every request
+			config.Retry = t.config.Retry
+
+			t.negotiator.remember(t.config.Address, name)
+			t.transport = transport
+			t.name = name
+
+			return nil
+		}
+
+		transport.Close()
+
+		// the device speaks this protocol but something else went wrong,
+		// probing further would only hide the actual error
+		if !isUnsupported(err, name != known) || ctx.Err() != nil {
+			return err
+		}
+
+		lastErr = err
+	}
+
+	return fmt.Errorf("no supported transport found for %s: %w", t.config.Address, lastErr)
+}
+
+// probeConfig returns the config of the transport to probe. An explicit
+// port of the target only applies to the transports its scheme implies,
+// the others use their own scheme and port: probing http://host:80 must
+// not send XOR frames or TLS handshakes to port 80, nor https://host:8443
+// AES requests to https://host. Probes are not retried, a transport the
+// device doesn't speak fails fast and the next one is probed.
+func (t *NegotiatingTransport) probeConfig(name string) (*model.DeviceConfig, error) {
+	target, err := targetOf(t.config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := target.Scheme
+
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	config := *t.config
+	config.Retry = nil
+
+	if target.Port != 0 && transportSchemes[name] != scheme {
+		own := *target
+		own.Scheme = transportSchemes[name]
+		own.Port = 0
+
+		config.Target = &own
+	}
+
+	return &config, nil
+}
+
+// isUnsupported reports whether the error means the device does not
+// speak the protocol, as opposed to a failure within the protocol. A
+// refused connection only counts while probing a transport not known to
+// work for the device, since known devices refuse connections while they
+// reboot.
+func isUnsupported(err error, probing bool) bool {
+	return errors.Is(err, ErrUnsupportedProtocol) || (probing && errors.Is(err, syscall.ECONNREFUSED))
+}
@@ -0,0 +1,195 @@
+package protocol_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// transportObserver records the transports that talked to the device.
+type transportObserver struct {
+	lock       sync.Mutex
+	transports map[string]bool
+}
+
+func (o *transportObserver) add(transport string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.transports == nil {
+		o.transports = make(map[string]bool)
+	}
+
+	o.transports[transport] = true
+}
+
+func (o *transportObserver) reset() map[string]bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	transports := o.transports
+	o.transports = nil
+
+	return transports
+}
+
+func (o *transportObserver) HandshakeStarted(event model.HandshakeEvent)  { o.add(event.Transport) }
+func (o *transportObserver) HandshakeFinished(event model.HandshakeEvent) {}
+func (o *transportObserver) LoginFinished(event model.LoginEvent)         { o.add(event.Transport) }
+func (o *transportObserver) RequestFinished(event model.RequestEvent)     { o.add(event.Transport) }
+
+func TestNegotiatorAes(t *testing.T) {
+	device := newDevice(t)
+
+	transport := protocol.NewNegotiator(testKey(t)).Transport(device.Config())
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	if name := transport.Negotiated(); name != protocol.TransportAes {
+		t.Errorf("negotiated %q, expected %q", name, protocol.TransportAes)
+	}
+}
+
+// TestNegotiatorKlap expects KLAP to be negotiated with devices that
+// don't answer AES handshakes, and new transports for the address to use
+// it without probing again.
+func TestNegotiatorKlap(t *testing.T) {
+	device := devicetest.NewKlapDevice(credentials)
+	t.Cleanup(device.Close)
+
+	observer := &transportObserver{}
+
+	config := device.Config()
+	config.Observer = observer
+
+	negotiator := protocol.NewNegotiator(testKey(t))
+	transport := negotiator.Transport(config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	if name := transport.Negotiated(); name != protocol.TransportKlap {
+		t.Errorf("negotiated %q, expected %q", name, protocol.TransportKlap)
+	}
+
+	if probed := observer.reset(); !probed[protocol.TransportAes] {
+		t.Errorf("got %v, expected %s to be probed first", probed, protocol.TransportAes)
+	}
+
+	transport = negotiator.Transport(config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	if name := transport.Negotiated(); name != protocol.TransportKlap {
+		t.Errorf("negotiated %q, expected the remembered %q", name, protocol.TransportKlap)
+	}
+
+	for name := range observer.reset() {
+		if name != protocol.TransportKlap {
+			t.Errorf("probed %s for a device known to speak %s", name, protocol.TransportKlap)
+		}
+	}
+
+	if calls := device.Calls("handshake1"); calls != 2 {
+		t.Errorf("got %d handshakes, expected one per transport", calls)
+	}
+}
+
+// TestNegotiatorRefused expects a device known to speak a transport to
+// keep it while it refuses connections, as it does while rebooting.
+func TestNegotiatorRefused(t *testing.T) {
+	device := newDevice(t)
+	observer := &transportObserver{}
+
+	config := device.Config()
+	config.Observer = observer
+
+	negotiator := protocol.NewNegotiator(testKey(t))
+	transport := negotiator.Transport(config)
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	device.Close()
+	observer.reset()
+
+	if _, err := getDeviceInfo(t, transport); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("got %v, expected the connection to be refused", err)
+	}
+
+	if name := transport.Negotiated(); name != protocol.TransportAes {
+		t.Errorf("negotiated %q after a refused connection, expected %q", name, protocol.TransportAes)
+	}
+
+	// new transports for the address start with the known transport and
+	// don't probe the others
+	if _, err := getDeviceInfo(t, negotiator.Transport(config)); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("got %v, expected the connection to be refused", err)
+	}
+
+	for name := range observer.reset() {
+		if name != protocol.TransportAes {
+			t.Errorf("probed %s for a device known to speak %s", name, protocol.TransportAes)
+		}
+	}
+}
+
+// TestNegotiatorProbesNotRetried expects the transports a device doesn't
+// speak to fail fast despite the retry policy, which applies again once
+// a transport is negotiated.
+func TestNegotiatorProbesNotRetried(t *testing.T) {
+	for _, port := range []string{"80", "9999"} {
+		if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+			conn.Close()
+			t.Skipf("port %s is in use, the probes wouldn't be refused", port)
+		}
+	}
+
+	device := newTLSDevice(t)
+
+	target, err := model.ParseTarget("https://" + device.Address())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := device.Config()
+	config.Target = target
+	config.Retry = &model.DefaultRetryPolicy
+
+	transport := protocol.NewNegotiator(testKey(t)).Transport(config)
+
+	start := time.Now()
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	// the first retry would wait for the backoff of the policy
+	if elapsed := time.Since(start); elapsed >= model.DefaultRetryPolicy.Backoff {
+		t.Errorf("negotiation took %s, expected refused probes not to be retried", elapsed)
+	}
+
+	if name := transport.Negotiated(); name != protocol.TransportTls {
+		t.Fatalf("negotiated %q, expected %q", name, protocol.TransportTls)
+	}
+
+	device.InjectFault(devicetest.Fault{Method: "get_device_info", StatusCode: 500, Times: 1})
+
+	if _, err := getDeviceInfo(t, transport); err != nil {
+		t.Errorf("negotiated transport did not retry: %v", err)
+	}
+}
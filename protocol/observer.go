@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/model"
+)
+
+var (
+	_ model.Observer = nopObserver{}
+	_ model.Observer = multiObserver{}
+	_ model.Observer = (*LoggingObserver)(nil)
+)
+
+type nopObserver struct{}
+
+func (nopObserver) HandshakeStarted(model.HandshakeEvent)  {}
+func (nopObserver) HandshakeFinished(model.HandshakeEvent) {}
+func (nopObserver) LoginFinished(model.LoginEvent)         {}
+func (nopObserver) RequestFinished(model.RequestEvent)     {}
+
+// observerFor returns the observer of the config, which is never nil.
+func observerFor(config *model.DeviceConfig) model.Observer {
+	if config.Observer == nil {
+		return nopObserver{}
+	}
+
+	return config.Observer
+}
+
+type multiObserver []model.Observer
+
+// MultiObserver returns an observer passing the events to all observers.
+func MultiObserver(observers ...model.Observer) model.Observer {
+	return multiObserver(observers)
+}
+
+func (m multiObserver) HandshakeStarted(event model.HandshakeEvent) {
+	for _, o := range m {
+		o.HandshakeStarted(event)
+	}
+}
+
+func (m multiObserver) HandshakeFinished(event model.HandshakeEvent) {
+	for _, o := range m {
+		o.HandshakeFinished(event)
+	}
+}
+
+func (m multiObserver) LoginFinished(event model.LoginEvent) {
+	for _, o := range m {
+		o.LoginFinished(event)
+	}
+}
+
+func (m multiObserver) RequestFinished(event model.RequestEvent) {
+	for _, o := range m {
+		o.RequestFinished(event)
+	}
+}
+
+// LoggingObserver logs the transport events, requests at debug level.
+type LoggingObserver struct{}
+
+func (*LoggingObserver) HandshakeStarted(event model.HandshakeEvent) {
+	logger.Debug("msg", "handshake started", "target", event.Address, "transport", event.Transport)
+}
+
+func (*LoggingObserver) HandshakeFinished(event model.HandshakeEvent) {
+	if event.Err != nil {
+		logger.Warn("msg", "handshake failed", "target", event.Address, "transport", event.Transport, "duration", event.Duration, "class", Classify(event.Err), "err", event.Err)
+		return
+	}
+
+	logger.Info("msg", "handshake finished", "target", event.Address, "transport", event.Transport, "duration", event.Duration)
+}
+
+func (*LoggingObserver) LoginFinished(event model.LoginEvent) {
+	if event.Err != nil {
+		logger.Warn("msg", "login failed", "target", event.Address, "transport", event.Transport, "login_version", event.LoginVersion, "default_credentials", event.DefaultCredentials, "err", event.Err)
+		return
+	}
+
+	logger.Info("msg", "login finished", "target", event.Address, "transport", event.Transport, "login_version", event.LoginVersion, "default_credentials", event.DefaultCredentials, "duration", event.Duration)
+}
+
+func (*LoggingObserver) RequestFinished(event model.RequestEvent) {
+	logger.Debug("msg", "request finished", "target", event.Address, "transport", event.Transport, "method", event.Method, "duration", event.Duration,
+		"request_bytes", event.RequestBytes, "response_bytes", event.ResponseBytes, "error_code", event.ErrorCode, "err", event.Err)
+}
+
+// observeHandshake runs the handshake, reporting it to the observer.
+func observeHandshake(config *model.DeviceConfig, transport string, handshake func() error) error {
+	observer := observerFor(config)
+
+	event := model.HandshakeEvent{
+		Address:   config.Address,
+		Transport: transport,
+	}
+
+	observer.HandshakeStarted(event)
+
+	start := time.Now()
+	err := handshake()
+
+	event.Duration = time.Since(start)
+	event.Err = err
+
+	observer.HandshakeFinished(event)
+
+	return err
+}
+
+// finishRequest completes the event with the outcome of the request and
+// reports it to the observer.
+func finishRequest(config *model.DeviceConfig, event *model.RequestEvent, start time.Time, response []byte, err error) {
+	event.Duration = time.Since(start)
+	event.Err = err
+
+	var deviceErr *DeviceError
+
+	if errors.As(err, &deviceErr) {
+		event.ErrorCode = int(deviceErr.Code)
+	} else if response != nil {
+		event.ErrorCode = int(responseErrorCode(response))
+	}
+
+	observerFor(config).RequestFinished(*event)
+}
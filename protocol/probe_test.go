@@ -0,0 +1,99 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/dehydr8/kasa-go/model"
+)
+
+// dialed returns where the transport connects to.
+func dialed(t *testing.T, transport Protocol) string {
+	switch transport := transport.(type) {
+	case *AesTransport:
+		return transport.url
+	case *KlapTransport:
+		return transport.url
+	case *LegacyTransport:
+		return transport.address
+	case *TlsTransport:
+		return transport.url
+	default:
+		t.Fatalf("unexpected transport %T", transport)
+		return ""
+	}
+}
+
+// TestProbePorts expects an explicit port to only apply to the
+// transports implied by the scheme of the target while probing, the
+// others using their own scheme and port.
+func TestProbePorts(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected map[string]string
+	}{
+		{
+			target: "192.168.1.2",
+			expected: map[string]string{
+				TransportAes:    "http://192.168.1.2/app",
+				TransportKlap:   "http://192.168.1.2/app",
+				TransportLegacy: "192.168.1.2:9999",
+				TransportTls:    "https://192.168.1.2:4433/app",
+			},
+		},
+		{
+			target: "192.168.1.2:80",
+			expected: map[string]string{
+				TransportAes:    "http://192.168.1.2:80/app",
+				TransportKlap:   "http://192.168.1.2:80/app",
+				TransportLegacy: "192.168.1.2:9999",
+				TransportTls:    "https://192.168.1.2:4433/app",
+			},
+		},
+		{
+			target: "https://192.168.1.2:8443",
+			expected: map[string]string{
+				TransportAes:    "http://192.168.1.2/app",
+				TransportKlap:   "http://192.168.1.2/app",
+				TransportLegacy: "192.168.1.2:9999",
+				TransportTls:    "https://192.168.1.2:8443/app",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			target, err := model.ParseTarget(tt.target)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			port := target.Port
+
+			negotiating := NewNegotiator(nil).Transport(&model.DeviceConfig{Address: tt.target, Target: target})
+
+			for name, expected := range tt.expected {
+				config, err := negotiating.probeConfig(name)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				transport, err := NewTransport(name, nil, config)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got := dialed(t, transport); got != expected {
+					t.Errorf("%s connects to %s, expected %s", name, got, expected)
+				}
+			}
+
+			// the target of the config is left as it is
+			if target.Port != port {
+				t.Errorf("probing changed the port of the target to %d, expected %d", target.Port, port)
+			}
+		})
+	}
+}
@@ -1,6 +1,67 @@
 package protocol
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/dehydr8/kasa-go/model"
+)
+
 type Protocol interface {
 	Send(request, response interface{}) error
+	SendContext(ctx context.Context, request, response interface{}) error
 	Close() error
 }
+
+// ErrClosed is returned for requests sent through a closed transport.
+var ErrClosed = errors.New("transport closed")
+
+// sendLock serializes requests to a device like a mutex, but waiting
+// for it can be abandoned when the context is done.
+type sendLock chan struct{}
+
+func newSendLock() sendLock {
+	return make(sendLock, 1)
+}
+
+func (l sendLock) Lock(ctx context.Context) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l sendLock) Unlock() {
+	<-l
+}
+
+// targetOf returns the target of the config, parsed from the address if
+// it is not set.
+func targetOf(config *model.DeviceConfig) (*model.Target, error) {
+	if config.Target != nil {
+		return config.Target, nil
+	}
+
+	return model.ParseTarget(config.Address)
+}
+
+// requestMethod returns the method of a marshalled request.
+func requestMethod(request json.RawMessage) string {
+	var base AesProtoBaseRequest
+
+	json.Unmarshal(request, &base)
+
+	return base.Method
+}
+
+// responseErrorCode returns the error code of a marshalled response.
+func responseErrorCode(response json.RawMessage) ErrorCode {
+	var base AesProtoBaseResponse
+
+	json.Unmarshal(response, &base)
+
+	return ErrorCode(base.ErrorCode)
+}
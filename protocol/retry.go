@@ -0,0 +1,91 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/model"
+)
+
+type retryAction int
+
+const (
+	retryGiveUp retryAction = iota
+	retryRehandshake
+	retryBackoff
+)
+
+// ParseErrorClass returns the error class with the given name.
+func ParseErrorClass(name string) (ErrorClass, error) {
+	for class := ErrorClassUnknown; class <= ErrorClassDevice; class++ {
+		if class.String() == name {
+			return class, nil
+		}
+	}
+
+	return ErrorClassUnknown, fmt.Errorf("unknown error class %s", name)
+}
+
+func retryActionFor(policy *model.RetryPolicy, err error) retryAction {
+	class := Classify(err).String()
+
+	for _, name := range policy.Rehandshake {
+		if name == class {
+			return retryRehandshake
+		}
+	}
+
+	for _, name := range policy.Retry {
+		if name == class {
+			return retryBackoff
+		}
+	}
+
+	return retryGiveUp
+}
+
+// withRetry calls send until it succeeds or the policy gives up, calling
+// reset before attempts that need a new session.
+func withRetry(ctx context.Context, policy *model.RetryPolicy, address string, reset func(), send func() error) error {
+	if policy == nil {
+		return send()
+	}
+
+	backoff := policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := send()
+
+		if err == nil || ctx.Err() != nil || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		switch retryActionFor(policy, err) {
+		case retryRehandshake:
+			logger.Debug("msg", "retrying request on new session", "target", address, "attempt", attempt, "err", err)
+
+			reset()
+		case retryBackoff:
+			logger.Debug("msg", "retrying request", "target", address, "attempt", attempt, "backoff", backoff, "err", err)
+
+			timer := time.NewTimer(backoff)
+
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+
+			backoff *= 2
+
+			if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+				backoff = policy.MaxBackoff
+			}
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dehydr8/kasa-go/logger"
+)
+
+var _ Protocol = (*Scheduler)(nil)
+
+// Priority orders the requests waiting for a device, higher first.
+type Priority int
+
+const (
+	// PriorityBackground is for polling, such as metrics scrapes
+	PriorityBackground Priority = iota
+
+	// PriorityInteractive is for reads a user is waiting for, the default
+	PriorityInteractive
+
+	// PriorityControl is for commands changing the state of the device
+	PriorityControl
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityControl:
+		return "control"
+	default:
+		return "unknown"
+	}
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose requests are scheduled with the
+// given priority.
+func WithPriority(ctx context.Context, priority Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// PriorityFromContext returns the priority of the context, interactive if
+// none is set.
+func PriorityFromContext(ctx context.Context) Priority {
+	if priority, ok := ctx.Value(priorityKey{}).(Priority); ok && priority >= PriorityBackground && priority <= PriorityControl {
+		return priority
+	}
+
+	return PriorityInteractive
+}
+
+// ErrQueueFull is returned for requests rejected because too many are
+// already waiting for the device, it is transient.
+var ErrQueueFull = fmt.Errorf("request queue full: %w", ErrTransient)
+
+const DefaultQueueLength = 16
+
+// Scheduler serializes the requests to a device by priority, so commands
+// don't wait behind polling. Identical concurrent reads are sent once and
+// share the response.
+type Scheduler struct {
+	inner    Protocol
+	maxQueue int
+
+	lock   sync.Mutex
+	busy   bool
+	queues [PriorityControl + 1][]chan error
+	queued int
+	calls  map[string]*call
+}
+
+// call is a read in flight, shared by identical reads.
+type call struct {
+	priority Priority
+	done     chan struct{}
+	response json.RawMessage
+	err      error
+}
+
+// NewScheduler schedules the requests to the inner transport, with at
+// most maxQueue requests waiting, DefaultQueueLength if not positive.
+func NewScheduler(inner Protocol, maxQueue int) *Scheduler {
+	if maxQueue <= 0 {
+		maxQueue = DefaultQueueLength
+	}
+
+	return &Scheduler{
+		inner:    inner,
+		maxQueue: maxQueue,
+		calls:    make(map[string]*call),
+	}
+}
+
+func (s *Scheduler) Send(request, response interface{}) error {
+	return s.SendContext(context.Background(), request, response)
+}
+
+func (s *Scheduler) SendContext(ctx context.Context, request, response interface{}) error {
+	marshalledRequest, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	if !isRead(marshalledRequest) {
+		return s.send(ctx, request, response)
+	}
+
+	priority := PriorityFromContext(ctx)
+	key := string(marshalledRequest)
+
+	for {
+		c, leader := s.join(key, priority)
+
+		if c == nil {
+			// an identical read of lower priority is in flight
+			return s.send(ctx, request, response)
+		}
+
+		if leader {
+			c.err = s.send(ctx, request, &c.response)
+
+			s.lock.Lock()
+			delete(s.calls, key)
+			s.lock.Unlock()
+
+			close(c.done)
+		} else {
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+
+			// the leader gave up, but this request may still be sent
+			if isContextError(c.err) && ctx.Err() == nil {
+				continue
+			}
+		}
+
+		if c.err != nil {
+			return c.err
+		}
+
+		if err := json.Unmarshal(c.response, response); err != nil {
+			return &DecodeError{Operation: requestMethod(marshalledRequest), Stage: DecodeStageResult, Err: err}
+		}
+
+		return nil
+	}
+}
+
+// join returns the call for the read and whether this request sends it,
+// or nil if the call in flight has a lower priority.
+func (s *Scheduler) join(key string, priority Priority) (*call, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if c, ok := s.calls[key]; ok {
+		if c.priority < priority {
+			return nil, false
+		}
+
+		return c, false
+	}
+
+	c := &call{
+		priority: priority,
+		done:     make(chan struct{}),
+	}
+
+	s.calls[key] = c
+
+	return c, true
+}
+
+func (s *Scheduler) send(ctx context.Context, request, response interface{}) error {
+	if err := s.acquire(ctx); err != nil {
+		return err
+	}
+	defer s.release()
+
+	return s.inner.SendContext(ctx, request, response)
+}
+
+// acquire waits for the turn of the request, rejecting it if the queue
+// is full of requests of the same or higher priority.
+func (s *Scheduler) acquire(ctx context.Context) error {
+	priority := PriorityFromContext(ctx)
+
+	s.lock.Lock()
+
+	if !s.busy {
+		s.busy = true
+		s.lock.Unlock()
+		return nil
+	}
+
+	if s.queued >= s.maxQueue && !s.evict(priority) {
+		s.lock.Unlock()
+
+		logger.Debug("msg", "rejecting request, queue full", "priority", priority)
+
+		return ErrQueueFull
+	}
+
+	ready := make(chan error, 1)
+
+	s.queues[priority] = append(s.queues[priority], ready)
+	s.queued++
+
+	s.lock.Unlock()
+
+	select {
+	case err := <-ready:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.lock.Lock()
+	removed := s.remove(priority, ready)
+	s.lock.Unlock()
+
+	// the turn came while giving up, pass it on
+	if !removed {
+		if err := <-ready; err == nil {
+			s.release()
+		}
+	}
+
+	return ctx.Err()
+}
+
+// evict rejects the newest waiting request of a lower priority, making
+// room for one of the given priority.
+func (s *Scheduler) evict(priority Priority) bool {
+	for p := PriorityBackground; p < priority; p++ {
+		if n := len(s.queues[p]); n > 0 {
+			s.queues[p][n-1] <- ErrQueueFull
+			s.queues[p] = s.queues[p][:n-1]
+			s.queued--
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Scheduler) remove(priority Priority, ready chan error) bool {
+	for i, waiting := range s.queues[priority] {
+		if waiting == ready {
+			s.queues[priority] = append(s.queues[priority][:i], s.queues[priority][i+1:]...)
+			s.queued--
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// release hands the turn to the oldest request of the highest priority.
+func (s *Scheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for p := PriorityControl; p >= PriorityBackground; p-- {
+		if len(s.queues[p]) > 0 {
+			s.queues[p][0] <- nil
+			s.queues[p] = s.queues[p][1:]
+			s.queued--
+
+			return
+		}
+	}
+
+	s.busy = false
+}
+
+func (s *Scheduler) Close() error {
+	return s.inner.Close()
+}
+
+// isRead returns whether the request only reads from the device: get_
+// methods, and batches and child requests made of them.
+func isRead(request json.RawMessage) bool {
+	var req struct {
+		Method string `json:"method"`
+		Params struct {
+			Requests    []json.RawMessage `json:"requests"`
+			RequestData json.RawMessage   `json:"requestData"`
+		} `json:"params"`
+	}
+
+	if err := json.Unmarshal(request, &req); err != nil {
+		return false
+	}
+
+	switch req.Method {
+	case "multipleRequest":
+		for _, inner := range req.Params.Requests {
+			if !isRead(inner) {
+				return false
+			}
+		}
+
+		return len(req.Params.Requests) > 0
+	case "control_child":
+		return isRead(req.Params.RequestData)
+	default:
+		return strings.HasPrefix(req.Method, "get_")
+	}
+}
@@ -0,0 +1,278 @@
+package protocol_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// blockingTransport holds every request until released, recording the
+// methods in the order they were sent.
+type blockingTransport struct {
+	started chan string
+	release chan struct{}
+
+	lock sync.Mutex
+	sent []string
+}
+
+func newBlockingTransport() *blockingTransport {
+	return &blockingTransport{
+		started: make(chan string, 16),
+		release: make(chan struct{}),
+	}
+}
+
+func (b *blockingTransport) Send(request, response interface{}) error {
+	return b.SendContext(context.Background(), request, response)
+}
+
+func (b *blockingTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	method := request.(map[string]interface{})["method"].(string)
+
+	b.lock.Lock()
+	b.sent = append(b.sent, method)
+	b.lock.Unlock()
+
+	b.started <- method
+
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return json.Unmarshal([]byte(fmt.Sprintf(`{"error_code":0,"result":{"method":%q}}`, method)), response)
+}
+
+func (b *blockingTransport) Close() error {
+	return nil
+}
+
+func (b *blockingTransport) methods() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return append([]string(nil), b.sent...)
+}
+
+// waitingContext closes waiting the first time the scheduler waits on
+// it, once the request is queued or waits for a read in flight.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func newWaitingContext(ctx context.Context) *waitingContext {
+	return &waitingContext{Context: ctx, waiting: make(chan struct{})}
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(func() { close(c.waiting) })
+
+	return c.Context.Done()
+}
+
+type methodResponse struct {
+	protocol.AesProtoBaseResponse
+	Result struct {
+		Method string `json:"method"`
+	} `json:"result"`
+}
+
+// sendAsync sends the method in the background, returning where its
+// error is delivered.
+func sendAsync(ctx context.Context, scheduler *protocol.Scheduler, method string) <-chan error {
+	errs := make(chan error, 1)
+
+	go func() {
+		var res methodResponse
+
+		err := scheduler.SendContext(ctx, map[string]interface{}{"method": method}, &res)
+
+		if err == nil && res.Result.Method != method {
+			err = fmt.Errorf("got the response of %s, expected %s", res.Result.Method, method)
+		}
+
+		errs <- err
+	}()
+
+	return errs
+}
+
+// queue sends the method with the priority, returning once it waits in
+// the queue.
+func queue(scheduler *protocol.Scheduler, priority protocol.Priority, method string) <-chan error {
+	ctx := newWaitingContext(protocol.WithPriority(context.Background(), priority))
+	errs := sendAsync(ctx, scheduler, method)
+
+	<-ctx.waiting
+
+	return errs
+}
+
+// busy sends a command the inner transport holds, so the following
+// requests have to wait.
+func busy(t *testing.T, scheduler *protocol.Scheduler, inner *blockingTransport) <-chan error {
+	t.Helper()
+
+	errs := sendAsync(context.Background(), scheduler, "set_busy")
+
+	if method := <-inner.started; method != "set_busy" {
+		t.Fatalf("got %s, expected set_busy to be sent first", method)
+	}
+
+	return errs
+}
+
+func expectSent(t *testing.T, inner *blockingTransport, expected ...string) {
+	t.Helper()
+
+	sent := inner.methods()
+
+	if fmt.Sprint(sent) != fmt.Sprint(expected) {
+		t.Errorf("got %v sent, expected %v", sent, expected)
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	inner := newBlockingTransport()
+	scheduler := protocol.NewScheduler(inner, 0)
+
+	errs := []<-chan error{
+		busy(t, scheduler, inner),
+		queue(scheduler, protocol.PriorityBackground, "set_background"),
+		queue(scheduler, protocol.PriorityInteractive, "set_interactive"),
+		queue(scheduler, protocol.PriorityControl, "set_control"),
+	}
+
+	close(inner.release)
+
+	for _, err := range errs {
+		if err := <-err; err != nil {
+			t.Errorf("request failed: %v", err)
+		}
+	}
+
+	expectSent(t, inner, "set_busy", "set_control", "set_interactive", "set_background")
+}
+
+func TestSchedulerQueueFull(t *testing.T) {
+	inner := newBlockingTransport()
+	scheduler := protocol.NewScheduler(inner, 2)
+
+	errs := []<-chan error{
+		busy(t, scheduler, inner),
+		queue(scheduler, protocol.PriorityControl, "set_first"),
+		queue(scheduler, protocol.PriorityControl, "set_second"),
+	}
+
+	// only waiting requests of a lower priority make room
+	for _, priority := range []protocol.Priority{protocol.PriorityBackground, protocol.PriorityInteractive, protocol.PriorityControl} {
+		err := <-sendAsync(protocol.WithPriority(context.Background(), priority), scheduler, "set_rejected")
+
+		if !errors.Is(err, protocol.ErrQueueFull) {
+			t.Errorf("got %v for a %s request, expected the queue to be full", err, priority)
+		}
+
+		if !errors.Is(err, protocol.ErrTransient) {
+			t.Errorf("got %v, expected a transient error", err)
+		}
+	}
+
+	close(inner.release)
+
+	for _, err := range errs {
+		if err := <-err; err != nil {
+			t.Errorf("request failed: %v", err)
+		}
+	}
+
+	expectSent(t, inner, "set_busy", "set_first", "set_second")
+}
+
+// TestSchedulerEviction expects a full queue to drop a waiting request
+// of a lower priority for a higher one.
+func TestSchedulerEviction(t *testing.T) {
+	inner := newBlockingTransport()
+	scheduler := protocol.NewScheduler(inner, 1)
+
+	busyErr := busy(t, scheduler, inner)
+	backgroundErr := queue(scheduler, protocol.PriorityBackground, "set_background")
+	controlErr := queue(scheduler, protocol.PriorityControl, "set_control")
+
+	if err := <-backgroundErr; !errors.Is(err, protocol.ErrQueueFull) {
+		t.Errorf("got %v for the background request, expected it to be evicted", err)
+	}
+
+	close(inner.release)
+
+	for _, err := range []<-chan error{busyErr, controlErr} {
+		if err := <-err; err != nil {
+			t.Errorf("request failed: %v", err)
+		}
+	}
+
+	expectSent(t, inner, "set_busy", "set_control")
+}
+
+func TestSchedulerCoalescing(t *testing.T) {
+	inner := newBlockingTransport()
+	scheduler := protocol.NewScheduler(inner, 0)
+
+	errs := []<-chan error{sendAsync(context.Background(), scheduler, "get_device_info")}
+
+	<-inner.started
+
+	for i := 0; i < 3; i++ {
+		errs = append(errs, queue(scheduler, protocol.PriorityInteractive, "get_device_info"))
+	}
+
+	close(inner.release)
+
+	for _, err := range errs {
+		if err := <-err; err != nil {
+			t.Errorf("request failed: %v", err)
+		}
+	}
+
+	expectSent(t, inner, "get_device_info")
+}
+
+// TestSchedulerCoalescingCancelled expects the followers of a read whose
+// sender gave up to still get a response.
+func TestSchedulerCoalescingCancelled(t *testing.T) {
+	inner := newBlockingTransport()
+	scheduler := protocol.NewScheduler(inner, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	leaderErr := sendAsync(ctx, scheduler, "get_device_info")
+
+	<-inner.started
+
+	followerErr := queue(scheduler, protocol.PriorityInteractive, "get_device_info")
+
+	cancel()
+
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v for the cancelled request, expected it to be cancelled", err)
+	}
+
+	// the follower sends the read itself
+	<-inner.started
+	close(inner.release)
+
+	if err := <-followerErr; err != nil {
+		t.Errorf("got %v for the follower, expected a response", err)
+	}
+
+	expectSent(t, inner, "get_device_info", "get_device_info")
+}
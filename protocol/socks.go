@@ -0,0 +1,254 @@
+package protocol
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthRejected = 0xff
+
+	socksConnect = 0x01
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+
+	socksDefaultPort = "1080"
+)
+
+// socksReplies maps the SOCKS5 reply codes to errors, so a device
+// refusing the connection behind the proxy is told apart like one
+// refusing it directly.
+var socksReplies = map[byte]error{
+	0x01: errors.New("general failure"),
+	0x02: errors.New("connection not allowed by ruleset"),
+	0x03: syscall.ENETUNREACH,
+	0x04: syscall.EHOSTUNREACH,
+	0x05: syscall.ECONNREFUSED,
+	0x06: errors.New("TTL expired"),
+	0x07: errors.New("command not supported"),
+	0x08: errors.New("address type not supported"),
+}
+
+// dialSocks5 connects to the address through the SOCKS5 proxy,
+// authenticating with the user of the proxy URL if it has one.
+func dialSocks5(ctx context.Context, dialer *net.Dialer, proxy *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxy.Host
+
+	if proxy.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), socksDefaultPort)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake is part of connecting, and shares its timeout
+	var deadline time.Time
+
+	if dialer.Timeout > 0 {
+		deadline = time.Now().Add(dialer.Timeout)
+	}
+
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	conn.SetDeadline(deadline)
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	if err := socksHandshake(conn, proxy.User, address); err != nil {
+		conn.Close()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		return nil, fmt.Errorf("socks5 proxy %s: %w", proxyAddress, err)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+func socksHandshake(conn net.Conn, user *url.Userinfo, address string) error {
+	methods := []byte{socksAuthNone}
+
+	if user != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return fmt.Errorf("authentication required")
+		}
+
+		if err := socksAuthenticate(conn, user); err != nil {
+			return err
+		}
+	case socksAuthRejected:
+		return fmt.Errorf("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unexpected authentication method %d", reply[1])
+	}
+
+	request, err := socksConnectRequest(address)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	return socksReadReply(conn, address)
+}
+
+// socksAuthenticate sends the username and password, RFC 1929.
+func socksAuthenticate(conn net.Conn, user *url.Userinfo) error {
+	username := user.Username()
+	password, _ := user.Password()
+
+	if len(username) > 255 || len(password) > 255 {
+		return fmt.Errorf("username or password too long")
+	}
+
+	request := []byte{1, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		return fmt.Errorf("authentication failed")
+	}
+
+	return nil
+}
+
+func socksConnectRequest(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %s", portString)
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %s too long", host)
+		}
+
+		request = append(request, socksAddressDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socksAddressIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socksAddressIPv6)
+		request = append(request, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(request, uint16(port)), nil
+}
+
+// socksReadReply reads the reply to the connect request, including the
+// address bound by the proxy.
+func socksReadReply(conn net.Conn, address string) error {
+	reply := make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected version %d", reply[0])
+	}
+
+	if reply[1] != 0 {
+		err, ok := socksReplies[reply[1]]
+
+		if !ok {
+			err = fmt.Errorf("unknown reply %d", reply[1])
+		}
+
+		return fmt.Errorf("connect to %s: %w", address, err)
+	}
+
+	var length int
+
+	switch reply[3] {
+	case socksAddressIPv4:
+		length = net.IPv4len
+	case socksAddressIPv6:
+		length = net.IPv6len
+	case socksAddressDomain:
+		size := make([]byte, 1)
+
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+
+		length = int(size[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", reply[3])
+	}
+
+	// the bound address and port are of no use
+	_, err := io.ReadFull(conn, make([]byte, length+2))
+
+	return err
+}
@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dehydr8/kasa-go/model"
+)
+
+var (
+	_ model.SessionStore = (*FileSessionStore)(nil)
+	_ model.PinStore     = (*FileSessionStore)(nil)
+)
+
+// FileSessionStore keeps the RSA key, the device sessions and the
+// certificate pins in a JSON file only readable by the owner, rewritten
+// on every change.
+type FileSessionStore struct {
+	path string
+
+	lock  sync.Mutex
+	state fileSessionState
+}
+
+type fileSessionState struct {
+	Key      string                         `json:"key,omitempty"`
+	Sessions map[string]*model.SessionState `json:"sessions"`
+	Pins     map[string]string              `json:"pins,omitempty"`
+}
+
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	store := &FileSessionStore{
+		path: path,
+		state: fileSessionState{
+			Sessions: make(map[string]*model.SessionState),
+		},
+	}
+
+	info, err := os.Stat(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("session file %s has permissions %o, expected 0600", path, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &store.state); err != nil {
+		return nil, fmt.Errorf("session file %s: %w", path, err)
+	}
+
+	if store.state.Sessions == nil {
+		store.state.Sessions = make(map[string]*model.SessionState)
+	}
+
+	return store, nil
+}
+
+// Key returns the stored RSA key, or nil if there is none.
+func (s *FileSessionStore) Key() (*rsa.PrivateKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.state.Key == "" {
+		return nil, nil
+	}
+
+	key, err := DecodeKey([]byte(s.state.Key))
+
+	if err != nil {
+		return nil, fmt.Errorf("session file %s: %w", s.path, err)
+	}
+
+	return key, nil
+}
+
+// SetKey stores the RSA key. Sessions are bound to the key they were
+// established with, so they are dropped if the key changes.
+func (s *FileSessionStore) SetKey(key *rsa.PrivateKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	encoded := string(EncodeKey(key))
+
+	if encoded == s.state.Key {
+		return nil
+	}
+
+	s.state.Key = encoded
+	s.state.Sessions = make(map[string]*model.SessionState)
+
+	return s.persist()
+}
+
+func (s *FileSessionStore) Load(address string) (*model.SessionState, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state, ok := s.state.Sessions[address]
+
+	if !ok || time.Now().After(state.Expiry) {
+		return nil, false
+	}
+
+	return state, true
+}
+
+func (s *FileSessionStore) Save(address string, state *model.SessionState) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state.Sessions[address] = state
+
+	return s.persist()
+}
+
+func (s *FileSessionStore) Delete(address string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.state.Sessions[address]; !ok {
+		return nil
+	}
+
+	delete(s.state.Sessions, address)
+
+	return s.persist()
+}
+
+func (s *FileSessionStore) Pin(address string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fingerprint, ok := s.state.Pins[address]
+
+	return fingerprint, ok
+}
+
+// SetPin stores the fingerprint, pins are kept when the key changes.
+func (s *FileSessionStore) SetPin(address, fingerprint string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.state.Pins == nil {
+		s.state.Pins = make(map[string]string)
+	}
+
+	s.state.Pins[address] = fingerprint
+
+	return s.persist()
+}
+
+// persist writes the state to a temporary file which replaces the old
+// one, so a crash never leaves a truncated file behind.
+func (s *FileSessionStore) persist() error {
+	now := time.Now()
+
+	for address, state := range s.state.Sessions {
+		if now.After(state.Expiry) {
+			delete(s.state.Sessions, address)
+		}
+	}
+
+	data, err := json.Marshal(&s.state)
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	// created with 0600
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
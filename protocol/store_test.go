@@ -0,0 +1,258 @@
+package protocol_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+func newSessionStore(t *testing.T, path string) *protocol.FileSessionStore {
+	t.Helper()
+
+	store, err := protocol.NewFileSessionStore(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func sessionState(expiry time.Time) *model.SessionState {
+	return &model.SessionState{
+		Key:     make([]byte, 32),
+		Cookies: map[string]string{"TP_SESSIONID": "session"},
+		Token:   "token",
+		Expiry:  expiry,
+	}
+}
+
+func TestFileSessionStorePermissions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	if err := os.WriteFile(path, []byte(`{"sessions":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := protocol.NewFileSessionStore(path); err == nil {
+		t.Errorf("expected a session file readable by others to be rejected")
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := protocol.NewFileSessionStore(path); err != nil {
+		t.Errorf("got %v, expected a session file only readable by the owner to load", err)
+	}
+}
+
+// TestFileSessionStoreAtomic expects every change to replace the file
+// with a complete one, leaving no temporary files behind.
+func TestFileSessionStoreAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.json")
+
+	store := newSessionStore(t, path)
+
+	if err := store.Save("192.168.1.2", sessionState(time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if perm := before.Mode().Perm(); perm != 0600 {
+		t.Errorf("got permissions %o, expected 0600", perm)
+	}
+
+	if err := store.Save("192.168.1.3", sessionState(time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if os.SameFile(before, after) {
+		t.Errorf("expected the file to be replaced, not rewritten in place")
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("got %d files, expected only the session file", len(entries))
+	}
+
+	for _, address := range []string{"192.168.1.2", "192.168.1.3"} {
+		if _, ok := newSessionStore(t, path).Load(address); !ok {
+			t.Errorf("session of %s not persisted", address)
+		}
+	}
+}
+
+func TestFileSessionStoreExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store := newSessionStore(t, path)
+
+	if err := store.Save("expired", sessionState(time.Now().Add(-time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.Load("expired"); ok {
+		t.Errorf("expected an expired session not to load")
+	}
+
+	if err := store.Save("valid", sessionState(time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state struct {
+		Sessions map[string]json.RawMessage `json:"sessions"`
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := state.Sessions["expired"]; ok || len(state.Sessions) != 1 {
+		t.Errorf("got sessions %v persisted, expected only the valid one", state.Sessions)
+	}
+}
+
+// TestFileSessionStoreKey expects sessions to be dropped when the key
+// they were established with changes.
+func TestFileSessionStoreKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store := newSessionStore(t, path)
+
+	if key, err := store.Key(); err != nil || key != nil {
+		t.Fatalf("got key %v and %v, expected no key", key, err)
+	}
+
+	if err := store.SetKey(testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Save("192.168.1.2", sessionState(time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	// setting the same key keeps the sessions
+	if err := store.SetKey(testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.Load("192.168.1.2"); !ok {
+		t.Errorf("session dropped when setting the same key")
+	}
+
+	restored, err := newSessionStore(t, path).Key()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !testKey(t).Equal(restored) {
+		t.Errorf("got a different key after reloading the store")
+	}
+
+	other, err := protocol.GenerateKey(1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SetKey(other); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.Load("192.168.1.2"); ok {
+		t.Errorf("expected the session to be dropped with a new key")
+	}
+
+	if _, ok := newSessionStore(t, path).Load("192.168.1.2"); ok {
+		t.Errorf("expected the persisted session to be dropped with a new key")
+	}
+}
+
+// TestAesRestoreSession expects a transport created with a stored
+// session, as after a restart, to use it without a handshake or login.
+func TestAesRestoreSession(t *testing.T) {
+	device := newDevice(t)
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	config := device.Config()
+	config.Sessions = newSessionStore(t, path)
+
+	if _, err := getDeviceInfo(t, newAesTransport(t, config)); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	config = device.Config()
+	config.Sessions = newSessionStore(t, path)
+
+	if _, err := getDeviceInfo(t, newAesTransport(t, config)); err != nil {
+		t.Fatalf("get_device_info failed with the restored session: %v", err)
+	}
+
+	for _, method := range []string{"handshake", "login_device"} {
+		if calls := device.Calls(method); calls != 1 {
+			t.Errorf("got %d %s, expected the session to be restored", calls, method)
+		}
+	}
+
+	if calls := device.Calls("get_device_info"); calls != 2 {
+		t.Errorf("got %d get_device_info, expected 2", calls)
+	}
+}
+
+// TestAesRestoreExpiredSession expects a stored session the device
+// dropped to be replaced by a new one.
+func TestAesRestoreExpiredSession(t *testing.T) {
+	device := newDevice(t)
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	config := device.Config()
+	config.Sessions = newSessionStore(t, path)
+
+	if _, err := getDeviceInfo(t, newAesTransport(t, config)); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	device.ExpireSessions()
+
+	config = device.Config()
+	config.Sessions = newSessionStore(t, path)
+	config.Retry = &model.DefaultRetryPolicy
+
+	if _, err := getDeviceInfo(t, newAesTransport(t, config)); err != nil {
+		t.Fatalf("get_device_info failed after the session expired: %v", err)
+	}
+
+	if calls := device.Calls("handshake"); calls != 2 {
+		t.Errorf("got %d handshakes, expected a new one for the expired session", calls)
+	}
+}
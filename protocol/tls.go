@@ -0,0 +1,370 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dehydr8/kasa-go/logger"
+	"github.com/dehydr8/kasa-go/model"
+)
+
+var _ Protocol = (*TlsTransport)(nil)
+
+// TlsPort is the port of the HTTPS API of newer firmware.
+const TlsPort = 4433
+
+// TlsTransport speaks the HTTPS API of newer firmware, where TLS protects
+// plain JSON requests. Devices use self-signed certificates, so instead of
+// verifying the chain the certificate is pinned on first use.
+type TlsTransport struct {
+	config *model.DeviceConfig
+	url    string
+
+	// the pin when the config has no pin store
+	pinLock sync.Mutex
+	pin     string
+
+	token string
+
+	httpClient *http.Client
+
+	closed   atomic.Bool
+	sendLock sendLock
+}
+
+type tlsRequest struct {
+	Method          string      `json:"method"`
+	Params          interface{} `json:"params"`
+	RequestTimeMils int64       `json:"request_time_milis"`
+}
+
+type tlsLoginParams struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Hashed   bool   `json:"hashed"`
+}
+
+type tlsLoginResponse struct {
+	AesProtoBaseResponse
+	Result struct {
+		Token string `json:"token"`
+	} `json:"result"`
+}
+
+func NewTlsTransport(config *model.DeviceConfig) (*TlsTransport, error) {
+	target, err := targetOf(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tlsTarget := *target
+	tlsTarget.Scheme = "https"
+
+	if tlsTarget.Port == 0 {
+		tlsTarget.Port = TlsPort
+	}
+
+	httpClient, err := NewHTTPClient(config.HTTP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TlsTransport{
+		config:     config,
+		url:        tlsTarget.URL("/app", ""),
+		httpClient: httpClient,
+		sendLock:   newSendLock(),
+	}
+
+	transport, ok := httpClient.Transport.(*http.Transport)
+
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	transport.TLSClientConfig = &tls.Config{
+		// the chain can't be verified, the pin is checked instead
+		InsecureSkipVerify: true,
+		VerifyConnection:   t.verifyPin,
+	}
+
+	httpClient.Transport = transport
+
+	return t, nil
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of the
+// certificate, as pinned by the TLS transport.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPin trusts the certificate of the device on first use, and
+// rejects it if it changes afterwards.
+func (t *TlsTransport) verifyPin(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("device presented no certificate")
+	}
+
+	fingerprint := CertificateFingerprint(state.PeerCertificates[0])
+
+	pinned, ok := t.pinned()
+
+	if !ok {
+		logger.Info("msg", "pinning device certificate on first use", "target", t.config.Address, "fingerprint", fingerprint)
+
+		return t.setPin(fingerprint)
+	}
+
+	if pinned != fingerprint {
+		return &PinError{Address: t.config.Address, Pinned: pinned, Fingerprint: fingerprint}
+	}
+
+	return nil
+}
+
+func (t *TlsTransport) pinned() (string, bool) {
+	if t.config.Pins != nil {
+		return t.config.Pins.Pin(t.config.Address)
+	}
+
+	t.pinLock.Lock()
+	defer t.pinLock.Unlock()
+
+	return t.pin, t.pin != ""
+}
+
+func (t *TlsTransport) setPin(fingerprint string) error {
+	if t.config.Pins != nil {
+		return t.config.Pins.SetPin(t.config.Address, fingerprint)
+	}
+
+	t.pinLock.Lock()
+	defer t.pinLock.Unlock()
+
+	t.pin = fingerprint
+
+	return nil
+}
+
+func (t *TlsTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *TlsTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if err := t.sendLock.Lock(ctx); err != nil {
+		return err
+	}
+	defer t.sendLock.Unlock()
+
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	return withRetry(ctx, t.config.Retry, t.config.Address, t.resetSession, func() error {
+		return t.send(ctx, request, response)
+	})
+}
+
+func (t *TlsTransport) send(ctx context.Context, request, response interface{}) error {
+	if t.token == "" {
+		if err := t.login(ctx); err != nil {
+			return err
+		}
+	}
+
+	err := t.request(ctx, request, response)
+
+	if err != nil && ctx.Err() == nil && Classify(err) == ErrorClassSession {
+		t.resetSession()
+	}
+
+	return err
+}
+
+func (t *TlsTransport) resetSession() {
+	t.token = ""
+}
+
+func (t *TlsTransport) Close() error {
+	t.closed.Store(true)
+	t.httpClient.CloseIdleConnections()
+
+	return nil
+}
+
+// login tries the credentials, and then the default credentials if
+// enabled, until one is accepted.
+func (t *TlsTransport) login(ctx context.Context) error {
+	credentials := []*model.Credentials{t.config.Credentials}
+
+	if t.config.TryDefaultCredentials {
+		for i := range model.DefaultCredentials {
+			credentials = append(credentials, &model.DefaultCredentials[i])
+		}
+	}
+
+	var err error
+
+	for _, creds := range credentials {
+		logger.Debug("msg", "performing tls login", "target", t.config.Address)
+
+		start := time.Now()
+
+		var token string
+
+		token, err = t.loginWith(ctx, creds)
+
+		observerFor(t.config).LoginFinished(model.LoginEvent{
+			Address:            t.config.Address,
+			Transport:          TransportTls,
+			DefaultCredentials: creds != t.config.Credentials,
+			Duration:           time.Since(start),
+			Err:                err,
+		})
+
+		if err == nil {
+			if creds != t.config.Credentials {
+				logger.Warn("msg", "device accepted default credentials", "target", t.config.Address, "username", creds.Username)
+			}
+
+			t.token = token
+
+			return nil
+		}
+
+		if Classify(err) != ErrorClassAuthentication || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (t *TlsTransport) loginWith(ctx context.Context, creds *model.Credentials) (string, error) {
+	if creds == nil || creds.Password == "" {
+		return "", fmt.Errorf("tls login needs the password, not the hashed password: %w", ErrAuthentication)
+	}
+
+	sum := md5.Sum([]byte(creds.Password))
+
+	var res tlsLoginResponse
+
+	_, err := t.post(ctx, t.url, &tlsRequest{
+		Method: "login",
+		Params: &tlsLoginParams{
+			Username: creds.Username,
+			Password: strings.ToUpper(hex.EncodeToString(sum[:])),
+			Hashed:   true,
+		},
+		RequestTimeMils: time.Now().UnixMilli(),
+	}, &res)
+
+	if err != nil {
+		return "", err
+	}
+
+	if res.ErrorCode != 0 {
+		return "", &DeviceError{Method: "login", Code: ErrorCode(res.ErrorCode)}
+	}
+
+	return res.Result.Token, nil
+}
+
+func (t *TlsTransport) request(ctx context.Context, request, response interface{}) error {
+	marshalledRequest, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	event := &model.RequestEvent{
+		Address:   t.config.Address,
+		Transport: TransportTls,
+		Method:    requestMethod(marshalledRequest),
+	}
+
+	start := time.Now()
+
+	logger.Debug("msg", "sending request", "target", t.config.Address, "request", string(marshalledRequest))
+
+	var raw json.RawMessage
+
+	event.RequestBytes, err = t.post(ctx, t.url+"?token="+t.token, json.RawMessage(marshalledRequest), &raw)
+
+	if err == nil {
+		event.ResponseBytes = len(raw)
+
+		logger.Debug("msg", "received response", "target", t.config.Address, "response", string(raw))
+
+		// an expired token is reported in place of the response
+		if code := responseErrorCode(raw); code.Class() == ErrorClassSession {
+			err = &DeviceError{Method: event.Method, Code: code}
+		} else if err = json.Unmarshal(raw, response); err != nil {
+			err = &DecodeError{Operation: "tls request", Stage: DecodeStageResult, Err: err}
+		}
+	}
+
+	finishRequest(t.config, event, start, raw, err)
+
+	return err
+}
+
+// post sends the request and returns the size of the request.
+func (t *TlsTransport) post(ctx context.Context, url string, request, response interface{}) (int, error) {
+	marshalled, err := json.Marshal(request)
+
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(marshalled))
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := t.httpClient.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return 0, &StatusError{Operation: "tls request", StatusCode: res.StatusCode}
+	}
+
+	body, err := io.ReadAll(res.Body)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := json.Unmarshal(body, response); err != nil {
+		return 0, &DecodeError{Operation: "tls request", Stage: DecodeStageJSON, Err: err}
+	}
+
+	return len(marshalled), nil
+}
@@ -0,0 +1,162 @@
+package protocol_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// pinStore keeps pins in memory and counts the pins set.
+type pinStore struct {
+	lock sync.Mutex
+	pins map[string]string
+	set  int
+}
+
+func (s *pinStore) Pin(address string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fingerprint, ok := s.pins[address]
+
+	return fingerprint, ok
+}
+
+func (s *pinStore) SetPin(address, fingerprint string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.pins == nil {
+		s.pins = make(map[string]string)
+	}
+
+	s.pins[address] = fingerprint
+	s.set++
+
+	return nil
+}
+
+func (s *pinStore) pinned() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.set
+}
+
+func newTLSDevice(t *testing.T) *devicetest.Device {
+	device := devicetest.NewTLSDevice(credentials)
+	t.Cleanup(device.Close)
+
+	return device
+}
+
+func newTlsTransport(t *testing.T, config *model.DeviceConfig) *protocol.TlsTransport {
+	transport, err := protocol.NewTlsTransport(config)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transport
+}
+
+func TestTlsPinOnFirstUse(t *testing.T) {
+	device := newTLSDevice(t)
+	store := &pinStore{}
+
+	config := device.Config()
+	config.Pins = store
+
+	transport := newTlsTransport(t, config)
+
+	for i := 0; i < 3; i++ {
+		if _, err := getDeviceInfo(t, transport); err != nil {
+			t.Fatalf("get_device_info failed: %v", err)
+		}
+	}
+
+	if pin, _ := store.Pin(config.Address); pin != device.Fingerprint() {
+		t.Errorf("got pin %q, expected %q", pin, device.Fingerprint())
+	}
+
+	if pinned := store.pinned(); pinned != 1 {
+		t.Errorf("pinned %d times, expected once", pinned)
+	}
+}
+
+func TestTlsPinReused(t *testing.T) {
+	device := newTLSDevice(t)
+
+	store := &pinStore{pins: map[string]string{device.Address(): device.Fingerprint()}}
+
+	config := device.Config()
+	config.Pins = store
+
+	if _, err := getDeviceInfo(t, newTlsTransport(t, config)); err != nil {
+		t.Fatalf("get_device_info failed with a stored pin: %v", err)
+	}
+
+	if pinned := store.pinned(); pinned != 0 {
+		t.Errorf("pinned %d times, expected the stored pin to be used", pinned)
+	}
+}
+
+func TestTlsPinMismatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		store model.PinStore
+	}{
+		{"in memory", nil},
+		{"stored", &pinStore{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := newTLSDevice(t)
+
+			config := device.Config()
+			config.Pins = tt.store
+
+			// a new connection for every request, so the next request sees
+			// the new certificate
+			config.HTTP = &model.HTTPOptions{DisableKeepAlives: true}
+
+			transport := newTlsTransport(t, config)
+
+			if _, err := getDeviceInfo(t, transport); err != nil {
+				t.Fatalf("get_device_info failed: %v", err)
+			}
+
+			pinned := device.Fingerprint()
+
+			if err := device.RotateCertificate(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := getDeviceInfo(t, transport)
+
+			var pinErr *protocol.PinError
+
+			if !errors.As(err, &pinErr) {
+				t.Fatalf("got %v, expected a pin error", err)
+			}
+
+			if pinErr.Pinned != pinned || pinErr.Fingerprint != device.Fingerprint() {
+				t.Errorf("got pin %q and fingerprint %q, expected %q and %q", pinErr.Pinned, pinErr.Fingerprint, pinned, device.Fingerprint())
+			}
+
+			if !errors.Is(err, protocol.ErrAuthentication) {
+				t.Errorf("got %v, expected an authentication error", err)
+			}
+
+			// the request never reached the device
+			if calls := device.Calls("get_device_info"); calls != 1 {
+				t.Errorf("got %d requests, expected 1", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	_ Protocol = (*RecordingTransport)(nil)
+	_ Protocol = (*ReplayTransport)(nil)
+)
+
+// TraceEntry is a decrypted request and its response, one JSON object
+// per line in a trace.
+type TraceEntry struct {
+	Time     time.Time       `json:"time"`
+	Duration time.Duration   `json:"duration"`
+	Method   string          `json:"method,omitempty"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+
+	// ErrorCode is the error code of the response, or of the DeviceError
+	// the transport failed with
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Class     string    `json:"class,omitempty"`
+}
+
+// RecordingTransport writes every request sent through the wrapped
+// transport to a JSONL trace.
+type RecordingTransport struct {
+	transport Protocol
+
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func NewRecordingTransport(transport Protocol, w io.Writer) *RecordingTransport {
+	return &RecordingTransport{
+		transport: transport,
+		w:         w,
+	}
+}
+
+func (t *RecordingTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *RecordingTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	marshalled, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	entry := &TraceEntry{
+		Time:    time.Now(),
+		Method:  requestMethod(marshalled),
+		Request: marshalled,
+	}
+
+	var raw json.RawMessage
+
+	err = t.transport.SendContext(ctx, request, &raw)
+
+	entry.Duration = time.Since(entry.Time)
+
+	if err != nil {
+		entry.Error = err.Error()
+		entry.Class = Classify(err).String()
+
+		var deviceErr *DeviceError
+		if errors.As(err, &deviceErr) {
+			entry.ErrorCode = deviceErr.Code
+		}
+	} else {
+		entry.Response = raw
+		entry.ErrorCode = responseErrorCode(raw)
+	}
+
+	if werr := t.write(entry); werr != nil {
+		return fmt.Errorf("unable to record trace: %w", werr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(raw, response); err != nil {
+		return &DecodeError{Operation: entry.Method, Stage: DecodeStageResult, Err: err}
+	}
+
+	return nil
+}
+
+func (t *RecordingTransport) write(entry *TraceEntry) error {
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, err = t.w.Write(append(line, '\n'))
+
+	return err
+}
+
+func (t *RecordingTransport) Close() error {
+	return t.transport.Close()
+}
+
+// ReplayTransport answers requests with the responses of a trace. A
+// request is matched to the recorded requests with the same body first
+// and the same method second, replaying their responses in order and
+// repeating the last one once they run out.
+type ReplayTransport struct {
+	lock      sync.Mutex
+	byRequest map[string]*traceCursor
+	byMethod  map[string]*traceCursor
+
+	closed atomic.Bool
+}
+
+type traceCursor struct {
+	entries []*TraceEntry
+	next    int
+}
+
+func (c *traceCursor) take() *TraceEntry {
+	entry := c.entries[c.next]
+
+	if c.next < len(c.entries)-1 {
+		c.next++
+	}
+
+	return entry
+}
+
+// NewReplayTransport reads a trace written by a RecordingTransport.
+func NewReplayTransport(r io.Reader) (*ReplayTransport, error) {
+	t := &ReplayTransport{
+		byRequest: make(map[string]*traceCursor),
+		byMethod:  make(map[string]*traceCursor),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry TraceEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+
+		key, err := traceKey(entry.Request)
+
+		if err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+
+		t.add(t.byRequest, key, &entry)
+		t.add(t.byMethod, entry.Method, &entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *ReplayTransport) add(index map[string]*traceCursor, key string, entry *TraceEntry) {
+	cursor, ok := index[key]
+
+	if !ok {
+		cursor = &traceCursor{}
+		index[key] = cursor
+	}
+
+	cursor.entries = append(cursor.entries, entry)
+}
+
+func (t *ReplayTransport) Send(request, response interface{}) error {
+	return t.SendContext(context.Background(), request, response)
+}
+
+func (t *ReplayTransport) SendContext(ctx context.Context, request, response interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if t.closed.Load() {
+		return ErrClosed
+	}
+
+	marshalled, err := json.Marshal(request)
+
+	if err != nil {
+		return err
+	}
+
+	key, err := traceKey(marshalled)
+
+	if err != nil {
+		return err
+	}
+
+	method := requestMethod(marshalled)
+
+	t.lock.Lock()
+
+	cursor, ok := t.byRequest[key]
+
+	if !ok {
+		cursor, ok = t.byMethod[method]
+	}
+
+	var entry *TraceEntry
+
+	if ok {
+		entry = cursor.take()
+	}
+
+	t.lock.Unlock()
+
+	if entry == nil {
+		return &DeviceError{Method: method, Code: ErrorCodeUnknownMethod}
+	}
+
+	if entry.Error != "" {
+		if entry.ErrorCode != 0 {
+			return &DeviceError{Method: method, Code: entry.ErrorCode}
+		}
+
+		// keep the class so that retries behave as recorded
+		if class, err := ParseErrorClass(entry.Class); err == nil && class.sentinel() != nil {
+			return fmt.Errorf("%s: %w", entry.Error, class.sentinel())
+		}
+
+		return errors.New(entry.Error)
+	}
+
+	if err := json.Unmarshal(entry.Response, response); err != nil {
+		return &DecodeError{Operation: method, Stage: DecodeStageResult, Err: err}
+	}
+
+	return nil
+}
+
+func (t *ReplayTransport) Close() error {
+	t.closed.Store(true)
+
+	return nil
+}
+
+// traceKey normalizes the request so that the order of the fields does
+// not matter.
+func traceKey(request json.RawMessage) (string, error) {
+	var value interface{}
+
+	if err := json.Unmarshal(request, &value); err != nil {
+		return "", err
+	}
+
+	normalized, err := json.Marshal(value)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(normalized), nil
+}
@@ -0,0 +1,162 @@
+package protocol_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+func setDeviceOn(transport protocol.Protocol, on bool) error {
+	var res protocol.AesProtoBaseResponse
+
+	return transport.SendContext(context.Background(), map[string]interface{}{
+		"method": "set_device_info",
+		"params": map[string]interface{}{"device_on": on},
+	}, &res)
+}
+
+func getEnergyUsage(transport protocol.Protocol) error {
+	var res protocol.AesProtoBaseResponse
+
+	return transport.SendContext(context.Background(), map[string]interface{}{"method": "get_energy_usage"}, &res)
+}
+
+// TestTraceReplay records requests to a device and expects the trace to
+// answer them the same way.
+func TestTraceReplay(t *testing.T) {
+	device := newDevice(t)
+
+	var trace bytes.Buffer
+
+	recorder := protocol.NewRecordingTransport(newAesTransport(t, device.Config()), &trace)
+
+	models := []string{devicetest.DefaultDeviceInfo["model"].(string), "P110"}
+
+	for _, model := range models {
+		device.Handle("get_device_info", devicetest.Result(map[string]interface{}{"model": model}))
+
+		if _, err := getDeviceInfo(t, recorder); err != nil {
+			t.Fatalf("get_device_info failed: %v", err)
+		}
+	}
+
+	if err := setDeviceOn(recorder, false); err != nil {
+		t.Fatalf("set_device_info failed: %v", err)
+	}
+
+	device.InjectFault(devicetest.Fault{Method: "securePassthrough", ErrorCode: protocol.ErrorCodeDevice, Times: 1})
+
+	recorded := getEnergyUsage(recorder)
+
+	if !errors.Is(recorded, protocol.ErrDeviceFailure) {
+		t.Fatalf("got %v, expected a device failure to record", recorded)
+	}
+
+	replay, err := protocol.NewReplayTransport(&trace)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// matched by body, in order, repeating the last response
+	for _, expected := range append(models, models[1]) {
+		res, err := getDeviceInfo(t, replay)
+
+		if err != nil {
+			t.Fatalf("get_device_info failed: %v", err)
+		}
+
+		if res.Result.Model != expected {
+			t.Errorf("got model %q, expected %q", res.Result.Model, expected)
+		}
+	}
+
+	// matched by method, the params differ from the recorded ones
+	if err := setDeviceOn(replay, true); err != nil {
+		t.Errorf("got %v, expected set_device_info to be replayed", err)
+	}
+
+	err = getEnergyUsage(replay)
+
+	var deviceErr *protocol.DeviceError
+
+	if !errors.As(err, &deviceErr) || deviceErr.Code != protocol.ErrorCodeDevice {
+		t.Errorf("got %v, expected the recorded device error", err)
+	}
+
+	if class := protocol.Classify(err); class != protocol.Classify(recorded) {
+		t.Errorf("got class %s, expected %s", class, protocol.Classify(recorded))
+	}
+
+	var res protocol.AesProtoBaseResponse
+
+	if err := replay.SendContext(context.Background(), map[string]interface{}{"method": "get_device_usage"}, &res); !errors.Is(err, protocol.ErrUnsupportedMethod) {
+		t.Errorf("got %v for a method not in the trace, expected it to be unsupported", err)
+	}
+}
+
+// TestTraceReplayTransient expects recorded errors without an error code
+// to keep their class, so retries behave as recorded.
+func TestTraceReplayTransient(t *testing.T) {
+	device := newDevice(t)
+
+	var trace bytes.Buffer
+
+	recorder := protocol.NewRecordingTransport(newAesTransport(t, device.Config()), &trace)
+
+	device.InjectFault(devicetest.Fault{Method: "securePassthrough", StatusCode: 500, Times: 1})
+
+	if _, err := getDeviceInfo(t, recorder); !errors.Is(err, protocol.ErrTransient) {
+		t.Fatalf("got %v, expected a transient error to record", err)
+	}
+
+	replay, err := protocol.NewReplayTransport(&trace)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := getDeviceInfo(t, replay); !errors.Is(err, protocol.ErrTransient) {
+		t.Errorf("got %v, expected a transient error", err)
+	}
+}
+
+// TestTraceResultMismatch expects responses that don't fit the result to
+// fail as decode errors, recorded or replayed.
+func TestTraceResultMismatch(t *testing.T) {
+	device := newDevice(t)
+
+	var trace bytes.Buffer
+
+	recorder := protocol.NewRecordingTransport(newAesTransport(t, device.Config()), &trace)
+
+	var res struct {
+		Result string `json:"result"`
+	}
+
+	request := map[string]interface{}{"method": "get_device_info"}
+
+	err := recorder.SendContext(context.Background(), request, &res)
+
+	var decodeErr *protocol.DecodeError
+
+	if !errors.As(err, &decodeErr) || decodeErr.Stage != protocol.DecodeStageResult {
+		t.Errorf("got %v recording, expected a result decode error", err)
+	}
+
+	replay, err := protocol.NewReplayTransport(&trace)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = replay.SendContext(context.Background(), request, &res)
+
+	if !errors.As(err, &decodeErr) || decodeErr.Stage != protocol.DecodeStageResult {
+		t.Errorf("got %v replaying, expected a result decode error", err)
+	}
+}
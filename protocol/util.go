@@ -66,7 +66,7 @@ func pkcs7Unpad(b []byte, blocksize int) ([]byte, error) {
 	}
 	c := b[len(b)-1]
 	n := int(c)
-	if n == 0 || n > len(b) {
+	if n == 0 || n > blocksize || n > len(b) {
 		return nil, ErrInvalidPKCS7Padding
 	}
 	for i := 0; i < n; i++ {
@@ -0,0 +1,456 @@
+// Package protocoltest is a conformance suite for protocol.Protocol
+// implementations, run against the fakes of the devicetest package.
+package protocoltest
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dehydr8/kasa-go/devicetest"
+	"github.com/dehydr8/kasa-go/model"
+	"github.com/dehydr8/kasa-go/protocol"
+)
+
+// Target is a transport under test and the fake device behind it.
+type Target struct {
+	Transport protocol.Protocol
+
+	// Device answers the requests of the transport, its handlers and
+	// faults are changed by the suite
+	Device *devicetest.Device
+
+	// Expire drops the session of the transport, the sessions of the
+	// device if nil
+	Expire func()
+
+	// Sessions counts the sessions established with the device, the
+	// handshakes or logins of the transport, nil for transports without
+	// sessions
+	Sessions func() int
+
+	// Translated is set for transports translating requests to another
+	// protocol, which only know the methods they translate
+	Translated bool
+}
+
+// Factory returns a new target for every test, cleaning it up with
+// t.Cleanup.
+type Factory func(t *testing.T) *Target
+
+// Run runs the conformance suite against the transports of the factory.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, target *Target)
+	}{
+		{"Request", testRequest},
+		{"SessionExpiry", testSessionExpiry},
+		{"Concurrent", testConcurrent},
+		{"ErrorCode", testErrorCode},
+		{"UnknownMethod", testUnknownMethod},
+		{"LargePayload", testLargePayload},
+		{"MalformedResponse", testMalformedResponse},
+		{"Cancel", testCancel},
+		{"Close", testClose},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, factory(t))
+		})
+	}
+}
+
+type request struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+type response struct {
+	ErrorCode int             `json:"error_code"`
+	Result    json.RawMessage `json:"result"`
+}
+
+type deviceInfoResponse struct {
+	ErrorCode int `json:"error_code"`
+	Result    struct {
+		Model string `json:"model"`
+	} `json:"result"`
+}
+
+// errorCode returns the error code of the method, reported either in the
+// response or as a device error.
+func errorCode(err error, res *response) (protocol.ErrorCode, error) {
+	var deviceErr *protocol.DeviceError
+
+	if errors.As(err, &deviceErr) {
+		return deviceErr.Code, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return protocol.ErrorCode(res.ErrorCode), nil
+}
+
+func getDeviceInfo(ctx context.Context, target *Target) (string, error) {
+	var res deviceInfoResponse
+
+	if err := target.Transport.SendContext(ctx, &request{Method: "get_device_info"}, &res); err != nil {
+		return "", err
+	}
+
+	if res.ErrorCode != 0 {
+		return "", &protocol.DeviceError{Method: "get_device_info", Code: protocol.ErrorCode(res.ErrorCode)}
+	}
+
+	return res.Result.Model, nil
+}
+
+func testRequest(t *testing.T, target *Target) {
+	model, err := getDeviceInfo(context.Background(), target)
+
+	if err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	if expected := devicetest.DefaultDeviceInfo["model"]; model != expected {
+		t.Errorf("got model %q, expected %q", model, expected)
+	}
+}
+
+// testSessionExpiry expects the transport to establish a new session
+// once the device expired it, by the next request at the latest.
+func testSessionExpiry(t *testing.T, target *Target) {
+	ctx := context.Background()
+
+	if _, err := getDeviceInfo(ctx, target); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	sessions := 0
+
+	if target.Sessions != nil {
+		sessions = target.Sessions()
+	}
+
+	if target.Expire != nil {
+		target.Expire()
+	} else {
+		target.Device.ExpireSessions()
+	}
+
+	if _, err := getDeviceInfo(ctx, target); err != nil {
+		if protocol.Classify(err) != protocol.ErrorClassSession {
+			t.Errorf("expired session failed with class %s: %v", protocol.Classify(err), err)
+		}
+
+		if _, err := getDeviceInfo(ctx, target); err != nil {
+			t.Fatalf("transport did not recover from the expired session: %v", err)
+		}
+	}
+
+	if target.Sessions != nil && target.Sessions() <= sessions {
+		t.Errorf("got %d sessions after the expiry, expected a new one after %d", target.Sessions(), sessions)
+	}
+}
+
+func testConcurrent(t *testing.T, target *Target) {
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 16)
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := getDeviceInfo(context.Background(), target); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("concurrent get_device_info failed: %v", err)
+	}
+}
+
+func testErrorCode(t *testing.T, target *Target) {
+	target.Device.Handle("get_energy_usage", func(json.RawMessage) (interface{}, protocol.ErrorCode) {
+		return nil, protocol.ErrorCodeCommonFailed
+	})
+
+	var res response
+
+	err := target.Transport.SendContext(context.Background(), &request{Method: "get_energy_usage"}, &res)
+
+	code, err := errorCode(err, &res)
+
+	if err != nil {
+		t.Fatalf("get_energy_usage failed: %v", err)
+	}
+
+	if code != protocol.ErrorCodeCommonFailed {
+		t.Errorf("got error code %d, expected %d", code, protocol.ErrorCodeCommonFailed)
+	}
+
+	// the session survives errors of the device
+	if _, err := getDeviceInfo(context.Background(), target); err != nil {
+		t.Errorf("get_device_info failed after an error code: %v", err)
+	}
+}
+
+func testUnknownMethod(t *testing.T, target *Target) {
+	var res response
+
+	err := target.Transport.SendContext(context.Background(), &request{Method: "get_unknown"}, &res)
+
+	code, err := errorCode(err, &res)
+
+	if err != nil {
+		t.Fatalf("get_unknown failed: %v", err)
+	}
+
+	if code != protocol.ErrorCodeUnknownMethod {
+		t.Errorf("got error code %d, expected %d", code, protocol.ErrorCodeUnknownMethod)
+	}
+}
+
+func testLargePayload(t *testing.T, target *Target) {
+	if target.Translated {
+		t.Skip("the transport only knows the methods it translates")
+	}
+
+	target.Device.Handle("get_echo", func(params json.RawMessage) (interface{}, protocol.ErrorCode) {
+		return params, protocol.ErrorCodeSuccess
+	})
+
+	payload := map[string]string{
+		"data": strings.Repeat("kasa", 64*1024),
+	}
+
+	var res response
+
+	if err := target.Transport.SendContext(context.Background(), &request{Method: "get_echo", Params: payload}, &res); err != nil {
+		t.Fatalf("get_echo failed: %v", err)
+	}
+
+	var echoed map[string]string
+
+	if err := json.Unmarshal(res.Result, &echoed); err != nil {
+		t.Fatalf("invalid echo: %v", err)
+	}
+
+	if echoed["data"] != payload["data"] {
+		t.Errorf("got %d bytes back, expected %d", len(echoed["data"]), len(payload["data"]))
+	}
+}
+
+// testMalformedResponse expects responses that don't decode to fail with
+// a decode error, and to leave the session usable.
+func testMalformedResponse(t *testing.T, target *Target) {
+	target.Device.Handle("get_device_info", devicetest.Result(map[string]interface{}{
+		"model": 110,
+	}))
+
+	_, err := getDeviceInfo(context.Background(), target)
+
+	var decodeErr *protocol.DecodeError
+
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("got %v, expected a decode error", err)
+	}
+
+	target.Device.Handle("get_device_info", devicetest.Result(devicetest.DefaultDeviceInfo))
+
+	if _, err := getDeviceInfo(context.Background(), target); err != nil {
+		t.Errorf("get_device_info failed after a malformed response: %v", err)
+	}
+}
+
+func testCancel(t *testing.T, target *Target) {
+	if _, err := getDeviceInfo(context.Background(), target); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	target.Device.InjectFault(devicetest.Fault{Method: "get_device_info", Delay: 500 * time.Millisecond, Times: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := getDeviceInfo(ctx, target)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expected the deadline to be exceeded", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("cancelled request returned after %s", elapsed)
+	}
+}
+
+func testClose(t *testing.T, target *Target) {
+	if _, err := getDeviceInfo(context.Background(), target); err != nil {
+		t.Fatalf("get_device_info failed: %v", err)
+	}
+
+	if err := target.Transport.Close(); err != nil {
+		t.Errorf("close failed: %v", err)
+	}
+
+	if err := target.Transport.Close(); err != nil {
+		t.Errorf("second close failed: %v", err)
+	}
+
+	if _, err := getDeviceInfo(context.Background(), target); !errors.Is(err, protocol.ErrClosed) {
+		t.Errorf("got %v sending through a closed transport, expected it to fail", err)
+	}
+}
+
+// Aes returns a factory for the AES transport.
+func Aes(key *rsa.PrivateKey) Factory {
+	return func(t *testing.T) *Target {
+		device := newDevice(t, devicetest.NewDevice)
+
+		transport, err := protocol.NewAesTransport(key, device.Config())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &Target{Transport: transport, Device: device, Sessions: calls(device, "handshake")}
+	}
+}
+
+// Klap returns a factory for the KLAP transport.
+func Klap() Factory {
+	return func(t *testing.T) *Target {
+		device := newDevice(t, devicetest.NewKlapDevice)
+
+		transport, err := protocol.NewKlapTransport(device.Config())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &Target{Transport: transport, Device: device, Sessions: calls(device, "handshake1")}
+	}
+}
+
+// Legacy returns a factory for the legacy XOR transport.
+func Legacy() Factory {
+	return func(t *testing.T) *Target {
+		device := devicetest.NewLegacyDevice()
+		t.Cleanup(device.Close)
+
+		transport, err := protocol.NewLegacyTransport(device.Config())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &Target{Transport: transport, Device: device, Translated: true}
+	}
+}
+
+// Tls returns a factory for the TLS transport.
+func Tls() Factory {
+	return func(t *testing.T) *Target {
+		device := newDevice(t, devicetest.NewTLSDevice)
+
+		transport, err := protocol.NewTlsTransport(device.Config())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &Target{Transport: transport, Device: device, Sessions: calls(device, "login")}
+	}
+}
+
+// Cloud returns a factory for the cloud transport.
+func Cloud() Factory {
+	return func(t *testing.T) *Target {
+		device := newDevice(t, devicetest.NewDevice)
+
+		cloud := devicetest.NewCloud(model.Credentials{Username: "user@example.com", Password: "password"})
+		t.Cleanup(cloud.Close)
+
+		cloud.AddDevice("device", device)
+
+		transport, err := protocol.NewCloudTransport(cloud.Config("device"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &Target{
+			Transport: transport,
+			Device:    device,
+			Expire:    cloud.ExpireTokens,
+			Sessions:  func() int { return cloud.Calls("login") },
+		}
+	}
+}
+
+// Child returns a factory for the child transport over the AES transport
+// of the parent.
+func Child(key *rsa.PrivateKey) Factory {
+	return func(t *testing.T) *Target {
+		parent := newDevice(t, devicetest.NewDevice)
+		child := newDevice(t, devicetest.NewDevice)
+
+		parent.AddChild("child", child)
+
+		transport, err := protocol.NewAesTransport(key, parent.Config())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &Target{
+			Transport: protocol.NewChildTransport(transport, "child"),
+			Device:    child,
+			Expire:    parent.ExpireSessions,
+			Sessions:  calls(parent, "handshake"),
+		}
+	}
+}
+
+// Scheduled wraps the transports of the factory in a scheduler.
+func Scheduled(factory Factory) Factory {
+	return func(t *testing.T) *Target {
+		target := factory(t)
+		target.Transport = protocol.NewScheduler(target.Transport, 0)
+
+		return target
+	}
+}
+
+// calls counts the requests of the method to the device.
+func calls(device *devicetest.Device, method string) func() int {
+	return func() int {
+		return device.Calls(method)
+	}
+}
+
+func newDevice(t *testing.T, start func(model.Credentials) *devicetest.Device) *devicetest.Device {
+	device := start(model.Credentials{Username: "user@example.com", Password: "password"})
+	t.Cleanup(device.Close)
+
+	return device
+}